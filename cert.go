@@ -0,0 +1,154 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CertTypeCA     = "ca"
+	CertTypeServer = "server"
+	CertTypeClient = "client"
+)
+
+// Certificate 生成的证书及其私钥
+type Certificate struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+	DER  []byte
+}
+
+// GenerateCertificate 生成ECDSA P-256证书，parent为nil时生成自签名的CA证书
+// 服务端证书的hosts可以是域名或IP，客户端证书的name作为CN，可用于识别客户端身份
+func GenerateCertificate(certType string, name string, hosts []string, validity time.Duration, parent *Certificate) (*Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	switch certType {
+	case CertTypeCA:
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	case CertTypeServer:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	case CertTypeClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown certificate type: %s", certType))
+	}
+
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{Cert: cert, Key: key, DER: der}, nil
+}
+
+// WriteTo 将证书和私钥以PEM格式写入文件，私钥仅允许当前用户读写
+func (c *Certificate) WriteTo(certPath string, keyPath string) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.DER})
+	if err := ioutil.WriteFile(certPath, certPEM, Perm0644); err != nil {
+		return errors.Wrapf(err, "Write certificate file[%s] failed", certPath)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.Key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyPath, keyPEM, Perm0600); err != nil {
+		return errors.Wrapf(err, "Write key file[%s] failed", keyPath)
+	}
+	return nil
+}
+
+// LoadCertificate 读取PEM格式的证书和私钥，用于签发新的证书
+func LoadCertificate(certPath string, keyPath string) (*Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read certificate file[%s]", certPath)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("No certificate found in %s", certPath))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read key file[%s]", keyPath)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("No private key found in %s", keyPath))
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{Cert: cert, Key: key, DER: cert.Raw}, nil
+}
+
+// LoadCertPool 读取PEM格式的CA证书
+func LoadCertPool(caPath string) (*x509.CertPool, error) {
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read ca file[%s]", caPath)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New(fmt.Sprintf("No certificate found in %s", caPath))
+	}
+	return pool, nil
+}
+
+// SPKIPin 返回证书公钥信息的SHA-256摘要，以base64编码，与HPKP中pin-sha256的格式一致
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCIDRs 解析网段列表，不带掩码的IP视为单个地址
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		network, err := ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// LoadCIDRs 从文件中加载网段列表，每行一个网段或IP，#之后的内容为注释
+func LoadCIDRs(filePath string) ([]*net.IPNet, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read cidr file[%s]", filePath)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var networks []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if index := strings.IndexByte(text, '#'); index >= 0 {
+			text = text[:index]
+		}
+		if text = strings.TrimSpace(text); len(text) == 0 {
+			continue
+		}
+		network, err := ParseCIDR(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid cidr at %s:%d", filePath, line)
+		}
+		networks = append(networks, network)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read cidr file[%s]", filePath)
+	}
+	return networks, nil
+}
+
+// ContainsIP 判断IP是否位于任一网段中
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDR 解析网段，不带掩码的IP视为单个地址
+func ParseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, errors.New(fmt.Sprintf("Invalid ip address: %s", value))
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// PortRange 端口范围，单个端口的From与To相同
+type PortRange struct {
+	From int
+	To   int
+}
+
+// Contains 判断端口是否位于范围内
+func (p PortRange) Contains(port int) bool {
+	return port >= p.From && port <= p.To
+}
+
+// ParsePortRange 解析80或8000-9000形式的端口范围
+func ParsePortRange(value string) (PortRange, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return PortRange{}, errors.Wrapf(err, "Invalid port: %s", value)
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return PortRange{}, errors.Wrapf(err, "Invalid port: %s", value)
+		}
+	}
+	if from < 0 || to > 65535 || from > to {
+		return PortRange{}, errors.New(fmt.Sprintf("Invalid port range: %s", value))
+	}
+	return PortRange{From: from, To: to}, nil
+}
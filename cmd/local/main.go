@@ -1,8 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
 
 	"github.com/sirupsen/logrus"
 
@@ -19,6 +25,7 @@ func main() {
 
 	app.Commands = []cli.Command{
 		configCmd,
+		pacCmd,
 		startCmd,
 		stopCmd,
 	}
@@ -40,10 +47,118 @@ var configCmd = cli.Command{
 			Name:  "r",
 			Usage: "Remote socks5 server address. eg: example.com:15680",
 		},
+		cli.StringSliceFlag{
+			Name:  "remote",
+			Usage: "Remote socks5 server with optional weight, can be repeated. eg: example.com:15680=2",
+		},
+		cli.StringFlag{
+			Name:  "strategy",
+			Usage: "Load balancing strategy between remotes: round_robin|least_connections|lowest_latency|sticky",
+		},
 		cli.IntFlag{
 			Name:  "p",
 			Usage: "Port of local socks5, must be greater than 1024. eg: 15678",
 		},
+		cli.StringFlag{
+			Name:  "u",
+			Usage: "Username for authentication with socks5-server",
+		},
+		cli.StringFlag{
+			Name:  "P",
+			Usage: "Password for authentication with socks5-server",
+		},
+		cli.StringFlag{
+			Name:  "l",
+			Usage: "Listen address of local socks5 and dns, defaults to 127.0.0.1. eg: 0.0.0.0",
+		},
+		cli.StringFlag{
+			Name:  "local-user",
+			Usage: "Username required from local applications, empty to disable local authentication",
+		},
+		cli.StringFlag{
+			Name:  "local-password",
+			Usage: "Password required from local applications",
+		},
+		cli.StringFlag{
+			Name:  "http",
+			Usage: "Enable or disable accepting http connect requests from local applications: on|off",
+		},
+		cli.IntFlag{
+			Name:  "dns-port",
+			Usage: "Port of local dns forwarding queries through socks5-server, 0 to disable. eg: 5353",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-direct",
+			Usage: "Domain suffix resolved by the local resolver, can be repeated. eg: intranet.example.com",
+		},
+		cli.StringFlag{
+			Name:  "dns-local-server",
+			Usage: "Local resolver for direct domains, use the system resolver if not specified. eg: 10.0.0.53:53",
+		},
+		cli.StringSliceFlag{
+			Name:  "forward",
+			Usage: "Static port forwarding through socks5-server, can be repeated. eg: 127.0.0.1:5433=db.internal:5432",
+		},
+		cli.StringSliceFlag{
+			Name:  "reverse",
+			Usage: "Reverse tunnel from a port of socks5-server to a local service, can be repeated. eg: 8080=127.0.0.1:3000",
+		},
+		cli.IntFlag{
+			Name:  "transparent-port",
+			Usage: "Port of transparent proxy for traffic redirected by iptables, 0 to disable, linux only. eg: 15679",
+		},
+		cli.StringFlag{
+			Name:  "transparent-mode",
+			Usage: "Mode of transparent proxy: redirect|tproxy",
+		},
+		cli.IntFlag{
+			Name:  "transparent-mark",
+			Usage: "SO_MARK of outgoing connections for excluding them in iptables, 0 to disable, linux only. eg: 255",
+		},
+		cli.StringFlag{
+			Name:  "k",
+			Usage: "Pre-shared key to encrypt traffic between socks5-local and socks5-server",
+		},
+		cli.StringFlag{
+			Name:  "c",
+			Usage: "Cipher of the encrypted traffic: aes-128-gcm|aes-256-gcm|chacha20-poly1305",
+		},
+		cli.StringFlag{
+			Name:  "t",
+			Usage: "Transport to socks5-server: tcp|tls|ws|wss",
+		},
+		cli.StringFlag{
+			Name:  "ws-path",
+			Usage: "Request path of ws/wss transport, must match the server. eg: /tunnel",
+		},
+		cli.StringFlag{
+			Name:  "sni",
+			Usage: "Server name of tls handshake, defaults to the host of remote address",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "Ca file to verify the server certificate",
+		},
+		cli.StringSliceFlag{
+			Name:  "pin",
+			Usage: "Base64 sha256 pin of the server public key, can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "Client certificate file for mutual tls",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "Private key file of the client certificate",
+		},
+		cli.StringFlag{
+			Name:  "mux",
+			Usage: "Enable or disable multiplexing connections over a few sessions to socks5-server: on|off",
+		},
+		cli.IntFlag{
+			Name:  "mux-sessions",
+			Usage: "Max number of multiplexing sessions. eg: 4",
+		},
 	},
 	Action: func(context *cli.Context) {
 		config := &local.Config{}
@@ -69,9 +184,111 @@ var configCmd = cli.Command{
 		if len(context.String("r")) > 0 {
 			config.RemoteAddress = context.String("r")
 		}
+		if len(context.StringSlice("remote")) > 0 {
+			remotes, err := parseRemotes(context.StringSlice("remote"))
+			if err != nil {
+				logrus.Errorf("Error occoured: %s", err.Error())
+				return
+			}
+			config.Remotes = remotes
+		}
+		if len(context.String("strategy")) > 0 {
+			config.Strategy = context.String("strategy")
+		}
 		if context.Int("p") > 1024 {
 			config.Port = context.Int("p")
 		}
+		if len(context.String("u")) > 0 {
+			config.Username = context.String("u")
+		}
+		if len(context.String("P")) > 0 {
+			config.Password = context.String("P")
+		}
+		if len(context.String("l")) > 0 {
+			config.ListenAddress = context.String("l")
+		}
+		if len(context.String("local-user")) > 0 {
+			config.LocalUsername = context.String("local-user")
+		}
+		if len(context.String("local-password")) > 0 {
+			config.LocalPassword = context.String("local-password")
+		}
+		switch context.String("http") {
+		case "on":
+			config.DisableHTTP = false
+		case "off":
+			config.DisableHTTP = true
+		}
+		if context.IsSet("dns-port") {
+			config.DNSPort = context.Int("dns-port")
+		}
+		if len(context.StringSlice("dns-direct")) > 0 {
+			config.DNSDirectDomains = context.StringSlice("dns-direct")
+		}
+		if len(context.String("dns-local-server")) > 0 {
+			config.DNSLocalServer = context.String("dns-local-server")
+		}
+		if len(context.StringSlice("forward")) > 0 {
+			forwards, err := parseForwards(context.StringSlice("forward"))
+			if err != nil {
+				logrus.Errorf("Error occoured: %s", err.Error())
+				return
+			}
+			config.Forwards = forwards
+		}
+		if len(context.StringSlice("reverse")) > 0 {
+			tunnels, err := parseReverseTunnels(context.StringSlice("reverse"))
+			if err != nil {
+				logrus.Errorf("Error occoured: %s", err.Error())
+				return
+			}
+			config.ReverseTunnels = tunnels
+		}
+		if context.IsSet("transparent-port") {
+			config.TransparentPort = context.Int("transparent-port")
+		}
+		if len(context.String("transparent-mode")) > 0 {
+			config.TransparentMode = context.String("transparent-mode")
+		}
+		if context.IsSet("transparent-mark") {
+			config.TransparentMark = context.Int("transparent-mark")
+		}
+		if len(context.String("k")) > 0 {
+			config.Key = context.String("k")
+		}
+		if len(context.String("c")) > 0 {
+			config.Cipher = context.String("c")
+		}
+		if len(context.String("t")) > 0 {
+			config.Transport = context.String("t")
+		}
+		if len(context.String("ws-path")) > 0 {
+			config.WebSocketPath = context.String("ws-path")
+		}
+		if len(context.String("sni")) > 0 {
+			config.TLSServerName = context.String("sni")
+		}
+		if len(context.String("tls-ca")) > 0 {
+			config.TLSCA = context.String("tls-ca")
+		}
+		if len(context.StringSlice("pin")) > 0 {
+			config.TLSPins = context.StringSlice("pin")
+		}
+		if len(context.String("tls-cert")) > 0 {
+			config.TLSCert = context.String("tls-cert")
+		}
+		if len(context.String("tls-key")) > 0 {
+			config.TLSKey = context.String("tls-key")
+		}
+		switch context.String("mux") {
+		case "on":
+			config.Mux = true
+		case "off":
+			config.Mux = false
+		}
+		if context.Int("mux-sessions") > 0 {
+			config.MuxSessions = context.Int("mux-sessions")
+		}
 		err = config.WriteTo(socks5.LocalSideConfigPath)
 		if err != nil {
 			logrus.Errorf("Error occoured: %s", err.Error())
@@ -82,6 +299,91 @@ var configCmd = cli.Command{
 	},
 }
 
+// parseRemotes 解析address=weight格式的服务端，未指定权重时为1
+func parseRemotes(values []string) ([]local.Remote, error) {
+	remotes := make([]local.Remote, 0, len(values))
+	for _, value := range values {
+		remote := local.Remote{Address: value, Weight: 1}
+		if i := strings.LastIndex(value, "="); i >= 0 {
+			weight, err := strconv.Atoi(value[i+1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid weight of remote[%s]", value)
+			}
+			remote.Address, remote.Weight = value[:i], weight
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes, nil
+}
+
+// parseForwards 解析listen=target格式的端口转发
+func parseForwards(values []string) ([]local.Forward, error) {
+	forwards := make([]local.Forward, 0, len(values))
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid forward[%s], expect listen=target", value))
+		}
+		forwards = append(forwards, local.Forward{Listen: value[:i], Target: value[i+1:]})
+	}
+	return forwards, nil
+}
+
+// parseReverseTunnels 解析remote_port=target格式的反向隧道
+func parseReverseTunnels(values []string) ([]local.ReverseTunnel, error) {
+	tunnels := make([]local.ReverseTunnel, 0, len(values))
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid reverse tunnel[%s], expect remote_port=target", value))
+		}
+		port, err := strconv.Atoi(value[:i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid remote port of reverse tunnel[%s]", value)
+		}
+		tunnels = append(tunnels, local.ReverseTunnel{RemotePort: port, Target: value[i+1:]})
+	}
+	return tunnels, nil
+}
+
+var pacCmd = cli.Command{
+	Name:  "pac",
+	Usage: "Generate a proxy auto-config file from the routes of socks5 local",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o",
+			Usage: "Output file of the pac, print to stdout if not specified. eg: proxy.pac",
+		},
+		cli.StringFlag{
+			Name:  "host",
+			Value: "127.0.0.1",
+			Usage: "Host of socks5 local used by the browser",
+		},
+	},
+	Action: func(context *cli.Context) {
+		config := &local.Config{}
+		if err := config.ReadFrom(socks5.LocalSideConfigPath); err != nil {
+			logrus.Errorf("Error occoured: %s", err.Error())
+			return
+		}
+
+		pac, err := local.GeneratePAC(config, context.String("host"))
+		if err != nil {
+			logrus.Errorf("Error occoured: %s", err.Error())
+			return
+		}
+		if len(context.String("o")) == 0 {
+			_, _ = os.Stdout.Write(pac)
+			return
+		}
+		if err := ioutil.WriteFile(context.String("o"), pac, socks5.Perm0644); err != nil {
+			logrus.Errorf("Error occoured: %s", err.Error())
+			return
+		}
+		logrus.Infof("Pac file generated: %s", context.String("o"))
+	},
+}
+
 var startCmd = cli.Command{
 	Name:  "start",
 	Usage: "StartServer socks5 local service",
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/liruonian/socks5/server"
+	"github.com/liruonian/socks5/server/auth"
 
 	"github.com/sirupsen/logrus"
 
@@ -19,6 +24,9 @@ func main() {
 
 	app.Commands = []cli.Command{
 		configCmd,
+		userCmd,
+		bansCmd,
+		genCertCmd,
 		startCmd,
 		stopCmd,
 	}
@@ -48,6 +56,70 @@ var configCmd = cli.Command{
 			Name:  "P",
 			Usage: "Password for authentication",
 		},
+		cli.StringFlag{
+			Name:  "m",
+			Usage: "Accepted authentication methods in order of preference, separated by comma. eg: gssapi,username_password",
+		},
+		cli.StringFlag{
+			Name:  "keytab",
+			Usage: "Keytab file of gssapi (kerberos) authentication",
+		},
+		cli.StringFlag{
+			Name:  "spn",
+			Usage: "Service principal in the keytab for gssapi authentication. eg: rcmd/proxy.example.com",
+		},
+		cli.StringFlag{
+			Name:  "socks4",
+			Usage: "Enable or disable socks4/socks4a on the same port: on|off",
+		},
+		cli.StringFlag{
+			Name:  "http",
+			Usage: "Enable or disable http proxy on the same port: on|off",
+		},
+		cli.IntFlag{
+			Name:  "t",
+			Usage: "Timeout in seconds to wait for the inbound connection of BIND command. eg: 60",
+		},
+		cli.StringFlag{
+			Name:  "k",
+			Usage: "Pre-shared key to encrypt traffic between socks5-local and socks5-server",
+		},
+		cli.StringFlag{
+			Name:  "c",
+			Usage: "Cipher of the encrypted traffic: aes-128-gcm|aes-256-gcm|chacha20-poly1305",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "Certificate file to terminate tls from socks5-local",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "Private key file of the tls certificate",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-ca",
+			Usage: "Ca file to require and verify client certificates",
+		},
+		cli.StringFlag{
+			Name:  "ws-path",
+			Usage: "Request path to accept websocket tunnels from socks5-local. eg: /tunnel",
+		},
+		cli.StringFlag{
+			Name:  "resolver",
+			Usage: "Resolver of destination domains: system|udp|tcp|doh",
+		},
+		cli.StringSliceFlag{
+			Name:  "resolver-server",
+			Usage: "Dns server of udp/tcp resolver or url of doh resolver, can be repeated. eg: 8.8.8.8:53, https://1.1.1.1/dns-query",
+		},
+		cli.StringFlag{
+			Name:  "dns",
+			Usage: "Enable or disable resolving dns queries from socks5-local: on|off",
+		},
+		cli.StringFlag{
+			Name:  "reverse-host",
+			Usage: "Listen host of reverse tunnels, listen on 127.0.0.1 if not specified. eg: 0.0.0.0",
+		},
 	},
 	Action: func(context *cli.Context) {
 		config := &server.Config{}
@@ -79,6 +151,63 @@ var configCmd = cli.Command{
 		if len(context.String("P")) > 0 {
 			config.Password = context.String("P")
 		}
+		if len(context.String("m")) > 0 {
+			config.AuthMethods = strings.Split(context.String("m"), ",")
+		}
+		if len(context.String("keytab")) > 0 {
+			config.GSSAPIKeytab = context.String("keytab")
+		}
+		if len(context.String("spn")) > 0 {
+			config.GSSAPIServicePrincipal = context.String("spn")
+		}
+		switch context.String("socks4") {
+		case "on":
+			config.DisableSocks4 = false
+		case "off":
+			config.DisableSocks4 = true
+		}
+		switch context.String("http") {
+		case "on":
+			config.DisableHTTP = false
+		case "off":
+			config.DisableHTTP = true
+		}
+		if context.Int("t") > 0 {
+			config.BindTimeout = context.Int("t")
+		}
+		if len(context.String("k")) > 0 {
+			config.Key = context.String("k")
+		}
+		if len(context.String("c")) > 0 {
+			config.Cipher = context.String("c")
+		}
+		if len(context.String("tls-cert")) > 0 {
+			config.TLSCert = context.String("tls-cert")
+		}
+		if len(context.String("tls-key")) > 0 {
+			config.TLSKey = context.String("tls-key")
+		}
+		if len(context.String("tls-client-ca")) > 0 {
+			config.TLSClientCA = context.String("tls-client-ca")
+		}
+		if len(context.String("ws-path")) > 0 {
+			config.WebSocketPath = context.String("ws-path")
+		}
+		if len(context.String("resolver")) > 0 {
+			config.Resolver = context.String("resolver")
+		}
+		if len(context.StringSlice("resolver-server")) > 0 {
+			config.ResolverServers = context.StringSlice("resolver-server")
+		}
+		switch context.String("dns") {
+		case "on":
+			config.DisableDNS = false
+		case "off":
+			config.DisableDNS = true
+		}
+		if len(context.String("reverse-host")) > 0 {
+			config.ReverseListenHost = context.String("reverse-host")
+		}
 		err = config.WriteTo(socks5.ServerSideConfigPath)
 		if err != nil {
 			logrus.Errorf("Error occoured: %s", err.Error())
@@ -89,6 +218,303 @@ var configCmd = cli.Command{
 	},
 }
 
+var userCmd = cli.Command{
+	Name:  "user",
+	Usage: "Manage users of username/password authentication",
+	Subcommands: []cli.Command{
+		{
+			Name:  "add",
+			Usage: "Add a user or reset the password of an existing user",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "u",
+					Usage: "Username",
+				},
+				cli.StringFlag{
+					Name:  "P",
+					Usage: "Password",
+				},
+				cli.StringFlag{
+					Name:  "g",
+					Usage: "Groups of the user, separated by comma",
+				},
+			},
+			Action: func(context *cli.Context) {
+				if len(context.String("u")) == 0 || len(context.String("P")) == 0 {
+					logrus.Errorf("Both username and password are required")
+					return
+				}
+				hash, err := auth.HashPassword(context.String("P"))
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				groups := parseList(context.String("g"))
+				modifyUsers(func(users []*auth.User) ([]*auth.User, error) {
+					for _, user := range users {
+						if user.Username == context.String("u") {
+							user.PasswordHash = hash
+							if context.IsSet("g") {
+								user.Groups = groups
+							}
+							return users, nil
+						}
+					}
+					return append(users, &auth.User{Username: context.String("u"), PasswordHash: hash, Groups: groups}), nil
+				})
+			},
+		},
+		{
+			Name:  "group",
+			Usage: "Set groups of a user, empty to remove the user from all groups",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "u",
+					Usage: "Username",
+				},
+				cli.StringFlag{
+					Name:  "g",
+					Usage: "Groups of the user, separated by comma",
+				},
+			},
+			Action: func(context *cli.Context) {
+				groups := parseList(context.String("g"))
+				modifyUsers(func(users []*auth.User) ([]*auth.User, error) {
+					for _, user := range users {
+						if user.Username == context.String("u") {
+							user.Groups = groups
+							return users, nil
+						}
+					}
+					return nil, auth.UserNotFoundError
+				})
+			},
+		},
+		{
+			Name:  "del",
+			Usage: "Delete a user",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "u",
+					Usage: "Username",
+				},
+			},
+			Action: func(context *cli.Context) {
+				modifyUsers(func(users []*auth.User) ([]*auth.User, error) {
+					for i, user := range users {
+						if user.Username == context.String("u") {
+							return append(users[:i], users[i+1:]...), nil
+						}
+					}
+					return nil, auth.UserNotFoundError
+				})
+			},
+		},
+		{
+			Name:  "enable",
+			Usage: "Enable a user",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "u",
+					Usage: "Username",
+				},
+			},
+			Action: func(context *cli.Context) {
+				setUserDisabled(context.String("u"), false)
+			},
+		},
+		{
+			Name:  "disable",
+			Usage: "Disable a user without deleting it",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "u",
+					Usage: "Username",
+				},
+			},
+			Action: func(context *cli.Context) {
+				setUserDisabled(context.String("u"), true)
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List all users",
+			Action: func(context *cli.Context) {
+				_, usersFile, err := readUsersConfig()
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				if _, err := os.Stat(usersFile); os.IsNotExist(err) {
+					return
+				}
+				users, err := auth.LoadUsers(usersFile)
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				for _, user := range users {
+					status := "enabled"
+					if user.Disabled {
+						status = "disabled"
+					}
+					fmt.Printf("%s\t%s\t%s\n", user.Username, status, strings.Join(user.Groups, ","))
+				}
+			},
+		},
+	},
+}
+
+func setUserDisabled(username string, disabled bool) {
+	modifyUsers(func(users []*auth.User) ([]*auth.User, error) {
+		for _, user := range users {
+			if user.Username == username {
+				user.Disabled = disabled
+				return users, nil
+			}
+		}
+		return nil, auth.UserNotFoundError
+	})
+}
+
+var bansCmd = cli.Command{
+	Name:  "bans",
+	Usage: "Manage temporary bans caused by authentication failures",
+	Subcommands: []cli.Command{
+		{
+			Name:  "list",
+			Usage: "List active bans",
+			Action: func(context *cli.Context) {
+				bansFile, err := readBansFile()
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				bans, err := auth.LoadBans(bansFile)
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				for _, ban := range bans {
+					fmt.Printf("%s\t%s\t%d failures\tuntil %s\n", ban.Type, ban.Value, ban.Failures, ban.Until.Local().Format(time.RFC3339))
+				}
+			},
+		},
+		{
+			Name:  "clear",
+			Usage: "Clear bans of an ip address or a user, or all bans if neither is specified",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ip",
+					Usage: "Client ip address",
+				},
+				cli.StringFlag{
+					Name:  "u",
+					Usage: "Username",
+				},
+			},
+			Action: func(context *cli.Context) {
+				bansFile, err := readBansFile()
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				bans, err := auth.LoadBans(bansFile)
+				if err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+
+				var remain []*auth.Ban
+				if context.IsSet("ip") || context.IsSet("u") {
+					for _, ban := range bans {
+						if (ban.Type == auth.BanTypeIP && ban.Value == context.String("ip")) ||
+							(ban.Type == auth.BanTypeUser && ban.Value == context.String("u")) {
+							continue
+						}
+						remain = append(remain, ban)
+					}
+				}
+				if err := auth.SaveBans(bansFile, remain); err != nil {
+					logrus.Errorf("Error occoured: %s", err.Error())
+					return
+				}
+				logrus.Infof("Cleared %d bans", len(bans)-len(remain))
+			},
+		},
+	},
+}
+
+func readBansFile() (string, error) {
+	config := &server.Config{}
+	err := config.ReadFrom(socks5.ServerSideConfigPath)
+	if err != nil && err != socks5.ConfigFileNotExist {
+		return "", err
+	}
+	return config.GetBansFile(), nil
+}
+
+// parseList 解析以逗号分隔的列表，忽略空白项
+func parseList(value string) []string {
+	var groups []string
+	for _, group := range strings.Split(value, ",") {
+		if group = strings.TrimSpace(group); len(group) != 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// readUsersConfig 读取服务端配置，未配置用户文件时使用默认路径
+func readUsersConfig() (*server.Config, string, error) {
+	config := &server.Config{}
+	err := config.ReadFrom(socks5.ServerSideConfigPath)
+	if err != nil && err != socks5.ConfigFileNotExist {
+		return nil, "", err
+	}
+	if len(config.UsersFile) != 0 {
+		return config, config.UsersFile, nil
+	}
+	return config, socks5.ServerSideUsersPath, nil
+}
+
+// modifyUsers 修改用户文件，首次使用时将默认的用户文件路径写入服务端配置
+func modifyUsers(modify func(users []*auth.User) ([]*auth.User, error)) {
+	config, usersFile, err := readUsersConfig()
+	if err != nil {
+		logrus.Errorf("Error occoured: %s", err.Error())
+		return
+	}
+
+	var users []*auth.User
+	if _, err := os.Stat(usersFile); err == nil {
+		users, err = auth.LoadUsers(usersFile)
+		if err != nil {
+			logrus.Errorf("Error occoured: %s", err.Error())
+			return
+		}
+	}
+
+	users, err = modify(users)
+	if err != nil {
+		logrus.Errorf("Error occoured: %s", err.Error())
+		return
+	}
+	if err := auth.SaveUsers(usersFile, users); err != nil {
+		logrus.Errorf("Error occoured: %s", err.Error())
+		return
+	}
+
+	if len(config.UsersFile) == 0 {
+		config.UsersFile = usersFile
+		if err := config.WriteTo(socks5.ServerSideConfigPath); err != nil {
+			logrus.Errorf("Error occoured: %s", err.Error())
+			return
+		}
+	}
+	logrus.Infof("Successful modification of the users file: %s", usersFile)
+}
+
 var startCmd = cli.Command{
 	Name:  "start",
 	Usage: "StartServer socks5 server service",
@@ -119,3 +545,86 @@ var stopCmd = cli.Command{
 		server.GetServer().StopServer()
 	},
 }
+
+var genCertCmd = cli.Command{
+	Name:  "gen-cert",
+	Usage: "Generate a self-signed ca, and server or client certificates signed by it",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "d",
+			Value: ".",
+			Usage: "Directory of the generated certificates, an existing ca.pem and ca-key.pem will be reused",
+		},
+		cli.StringFlag{
+			Name:  "hosts",
+			Usage: "Domain names or ip addresses of the server certificate, separated by comma. eg: example.com,203.0.113.1",
+		},
+		cli.StringFlag{
+			Name:  "client",
+			Usage: "Common name of the client certificate for mutual tls",
+		},
+		cli.IntFlag{
+			Name:  "days",
+			Value: 825,
+			Usage: "Validity of the generated certificates in days",
+		},
+	},
+	Action: func(context *cli.Context) {
+		dir := context.String("d")
+		validity := time.Duration(context.Int("days")) * 24 * time.Hour
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logrus.Errorf("Error occured: %s", err.Error())
+			return
+		}
+
+		// 目录中已经存在CA时继续使用，便于追加签发证书，只有两个文件都不存在时才生成新的CA，
+		// 读取失败时覆盖会使已经签发的证书以及固定的公钥全部失效
+		caCert, caKey := path.Join(dir, "ca.pem"), path.Join(dir, "ca-key.pem")
+		_, certErr := os.Stat(caCert)
+		_, keyErr := os.Stat(caKey)
+		var ca *socks5.Certificate
+		var err error
+		if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+			ca, err = socks5.LoadCertificate(caCert, caKey)
+			if err != nil {
+				logrus.Errorf("Error occured while load ca, remove both %s and %s to generate a new one: %s", caCert, caKey, err.Error())
+				return
+			}
+		} else {
+			ca, err = socks5.GenerateCertificate(socks5.CertTypeCA, socks5.ServerSideName+" ca", nil, validity, nil)
+			if err == nil {
+				err = ca.WriteTo(caCert, caKey)
+			}
+			if err != nil {
+				logrus.Errorf("Error occured: %s", err.Error())
+				return
+			}
+			logrus.Infof("Generated ca: %s, pin: %s", caCert, socks5.SPKIPin(ca.Cert))
+		}
+
+		if hosts := parseList(context.String("hosts")); len(hosts) != 0 {
+			cert, err := socks5.GenerateCertificate(socks5.CertTypeServer, hosts[0], hosts, validity, ca)
+			if err == nil {
+				err = cert.WriteTo(path.Join(dir, "server.pem"), path.Join(dir, "server-key.pem"))
+			}
+			if err != nil {
+				logrus.Errorf("Error occured: %s", err.Error())
+				return
+			}
+			logrus.Infof("Generated server certificate: %s, pin: %s", path.Join(dir, "server.pem"), socks5.SPKIPin(cert.Cert))
+		}
+
+		if name := context.String("client"); len(name) != 0 {
+			certPath, keyPath := path.Join(dir, fmt.Sprintf("client-%s.pem", name)), path.Join(dir, fmt.Sprintf("client-%s-key.pem", name))
+			cert, err := socks5.GenerateCertificate(socks5.CertTypeClient, name, nil, validity, ca)
+			if err == nil {
+				err = cert.WriteTo(certPath, keyPath)
+			}
+			if err != nil {
+				logrus.Errorf("Error occured: %s", err.Error())
+				return
+			}
+			logrus.Infof("Generated client certificate: %s", certPath)
+		}
+	},
+}
@@ -14,6 +14,7 @@ const (
 	LocalSideName  = name + "-local"
 
 	Perm0644 = 0644
+	Perm0600 = 0600
 
 	Tcp = "tcp"
 
@@ -25,5 +26,7 @@ var (
 	ServerSideConfigPath = path.Join(HomePath, fmt.Sprintf(".%s.json", ServerSideName))
 	LocalSideConfigPath  = path.Join(HomePath, fmt.Sprintf(".%s.json", LocalSideName))
 	ServerSidePidPath    = path.Join(HomePath, fmt.Sprintf(".%s.pid", ServerSideName))
+	ServerSideUsersPath  = path.Join(HomePath, fmt.Sprintf(".%s.users.json", ServerSideName))
+	ServerSideBansPath   = path.Join(HomePath, fmt.Sprintf(".%s.bans.json", ServerSideName))
 	LocalSidePidPath     = path.Join(HomePath, fmt.Sprintf(".%s.pid", LocalSideName))
 )
@@ -0,0 +1,64 @@
+package local
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5/proxy"
+)
+
+const authFailure = uint8(1)
+
+// localAuthRequired 配置了本地用户名时，本地应用需要认证后才能使用代理
+func (s *server) localAuthRequired() bool {
+	return len(s.config.LocalUsername) != 0
+}
+
+// verifyLocal 使用常量时间比较，避免通过响应时间猜测密码
+func (s *server) verifyLocal(username string, password string) bool {
+	userMatch := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.LocalUsername))
+	passMatch := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.LocalPassword))
+	return userMatch&passMatch == 1
+}
+
+// authenticateLocal 完成本地应用的USERNAME/PASSWORD认证，参考RFC 1929
+func (s *server) authenticateLocal(reader io.Reader, writer io.Writer) error {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != authVersion {
+		return errors.New(fmt.Sprintf("Unsupported auth version, expect %v, get %v", authVersion, header[0]))
+	}
+	username := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(reader, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(reader, password); err != nil {
+		return err
+	}
+
+	if !s.verifyLocal(string(username), string(password)) {
+		_, _ = writer.Write([]byte{authVersion, authFailure})
+		return errors.New(fmt.Sprintf("Authentication failed for user %s", string(username)))
+	}
+	_, err := writer.Write([]byte{authVersion, authSuccess})
+	return err
+}
+
+// authenticateHTTP 校验HTTP CONNECT请求的Proxy-Authorization
+func (s *server) authenticateHTTP(req *http.Request) bool {
+	if !s.localAuthRequired() {
+		return true
+	}
+	username, password, ok := proxy.ParseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	return ok && s.verifyLocal(username, password)
+}
@@ -0,0 +1,364 @@
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyLowestLatency    = "lowest_latency"
+	StrategySticky           = "sticky"
+
+	// 延迟的指数加权移动平均中，最新一次测量所占的比重
+	latencySmoothing = 0.3
+)
+
+// upstream 一个socks5服务端，连续失败达到阈值后熔断，熔断时间结束后允许一次试探
+type upstream struct {
+	address   string
+	weight    int
+	tlsConfig *tls.Config
+	muxPool   *muxPool
+
+	lock          sync.Mutex
+	active        int
+	currentWeight int
+	latency       time.Duration
+	healthy       bool
+	failures      int
+	openUntil     time.Time
+	probing       bool
+}
+
+// available 判断是否可以向该服务端发起连接，熔断结束后只放行一次试探
+func (u *upstream) available(now time.Time, threshold int) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if !u.healthy {
+		return false
+	}
+	if u.failures < threshold {
+		return true
+	}
+	if now.Before(u.openUntil) || u.probing {
+		return false
+	}
+	u.probing = true
+	return true
+}
+
+func (u *upstream) acquire() {
+	u.lock.Lock()
+	u.active++
+	u.lock.Unlock()
+}
+
+func (u *upstream) release() {
+	u.lock.Lock()
+	u.active--
+	u.lock.Unlock()
+}
+
+// succeed 连接成功后关闭熔断，并更新延迟，latency为0时不更新延迟
+func (u *upstream) succeed(latency time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.healthy = true
+	u.failures = 0
+	u.probing = false
+	u.updateLatency(latency)
+}
+
+// checked 健康检查成功，只更新可用状态和延迟，熔断只能由真实连接的成功关闭
+func (u *upstream) checked(latency time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.healthy = true
+	u.updateLatency(latency)
+}
+
+// updateLatency 调用方需持有锁
+func (u *upstream) updateLatency(latency time.Duration) {
+	if latency == 0 {
+		return
+	}
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		u.latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(u.latency))
+	}
+}
+
+// fail 记录一次连接失败，达到阈值或试探失败时开启熔断
+func (u *upstream) fail(threshold int, timeout time.Duration) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.failures++
+	u.probing = false
+	if u.failures >= threshold {
+		u.openUntil = time.Now().Add(timeout)
+		return true
+	}
+	return false
+}
+
+// balancer 按照策略在多个服务端之间分配连接，连接失败时自动切换到其他服务端
+type balancer struct {
+	server    *server
+	strategy  string
+	upstreams []*upstream
+
+	// 平滑加权轮询需要在选择时同时修改所有服务端的当前权重
+	lock sync.Mutex
+}
+
+func newBalancer(s *server) (*balancer, error) {
+	b := &balancer{server: s, strategy: s.config.Strategy}
+	if len(b.strategy) == 0 {
+		b.strategy = StrategyRoundRobin
+	}
+
+	for _, remote := range s.config.GetRemotes() {
+		u := &upstream{address: remote.Address, weight: remote.Weight, healthy: true}
+		if u.weight <= 0 {
+			u.weight = 1
+		}
+		if s.config.Transport == TransportTLS || s.config.Transport == TransportWSS {
+			tlsConfig, err := s.newTLSConfig(remote.Address)
+			if err != nil {
+				return nil, err
+			}
+			u.tlsConfig = tlsConfig
+		}
+		if s.config.Mux {
+			u.muxPool = newMuxPool(s, u)
+		}
+		b.upstreams = append(b.upstreams, u)
+	}
+	return b, nil
+}
+
+// open 选择服务端建立连接并完成socks5的认证协商，失败时依次尝试其余的服务端，关闭返回的连接时释放服务端的连接计数
+// mux为false时不经过多路复用会话，单独建立连接
+func (b *balancer) open(ctx context.Context, key string, mux bool) (net.Conn, *upstream, error) {
+	config := b.server.config
+	tried := make(map[*upstream]bool, len(b.upstreams))
+	var lastErr error
+	for len(tried) < len(b.upstreams) {
+		u := b.pick(key, tried)
+		tried[u] = true
+
+		start := time.Now()
+		var conn net.Conn
+		var err error
+		if mux {
+			conn, err = b.server.dialUpstream(ctx, u)
+		} else {
+			conn, err = b.server.dialRemote(ctx, u)
+		}
+		if err == nil {
+			if err = b.server.negotiateWithin(conn, dialTimeout); err != nil {
+				_ = conn.Close()
+				err = errors.Wrapf(err, "Socks5 negotiation with %s failed", u.address)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			if u.fail(config.GetFailureThreshold(), config.GetCircuitBreakTimeout()) {
+				logrus.Warnf("Remote %s is unavailable: %s", u.address, err.Error())
+			} else {
+				logrus.Errorf("Error occured while dial remote addr[%s]: %s", u.address, err.Error())
+			}
+			continue
+		}
+		// 多路复用时打开逻辑连接并协商的耗时不能反映建立连接的延迟，由健康检查测量
+		latency := time.Since(start)
+		if mux && u.muxPool != nil {
+			latency = 0
+		}
+		u.succeed(latency)
+		u.acquire()
+		return &upstreamConn{Conn: conn, upstream: u}, u, nil
+	}
+	return nil, nil, errors.Wrapf(lastErr, "All remotes failed")
+}
+
+// pick 按照策略在可用的服务端中选择，没有可用的服务端时在尚未尝试的服务端中选择
+func (b *balancer) pick(key string, tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	threshold := b.server.config.GetFailureThreshold()
+	var candidates []*upstream
+	for _, u := range b.upstreams {
+		if !tried[u] && u.available(now, threshold) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, u := range b.upstreams {
+			if !tried[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+
+	switch b.strategy {
+	case StrategyLeastConnections:
+		return pickLeastConnections(candidates)
+	case StrategyLowestLatency:
+		return pickLowestLatency(candidates)
+	case StrategySticky:
+		return pickSticky(candidates, key)
+	default:
+		return b.pickRoundRobin(candidates)
+	}
+}
+
+// pickRoundRobin 平滑加权轮询，与nginx的实现一致
+func (b *balancer) pickRoundRobin(candidates []*upstream) *upstream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	total := 0
+	var selected *upstream
+	for _, u := range candidates {
+		u.lock.Lock()
+		u.currentWeight += u.weight
+		total += u.weight
+		if selected == nil || u.currentWeight > selected.currentWeight {
+			selected = u
+		}
+		u.lock.Unlock()
+	}
+	selected.lock.Lock()
+	selected.currentWeight -= total
+	selected.lock.Unlock()
+	return selected
+}
+
+// pickLeastConnections 选择连接数与权重之比最小的服务端
+func pickLeastConnections(candidates []*upstream) *upstream {
+	var selected *upstream
+	var selectedActive int
+	for _, u := range candidates {
+		u.lock.Lock()
+		active := u.active
+		u.lock.Unlock()
+		if selected == nil || active*selected.weight < selectedActive*u.weight {
+			selected, selectedActive = u, active
+		}
+	}
+	return selected
+}
+
+// pickLowestLatency 选择最近测得延迟最低的服务端，尚未测得延迟的服务端优先
+func pickLowestLatency(candidates []*upstream) *upstream {
+	var selected *upstream
+	var selectedLatency time.Duration
+	for _, u := range candidates {
+		u.lock.Lock()
+		latency := u.latency
+		u.lock.Unlock()
+		if selected == nil || latency < selectedLatency {
+			selected, selectedLatency = u, latency
+		}
+	}
+	return selected
+}
+
+// pickSticky 使用rendezvous哈希，相同的key总是落在同一个服务端上，服务端不可用时只影响落在其上的key
+func pickSticky(candidates []*upstream, key string) *upstream {
+	var selected *upstream
+	var selectedScore uint64
+	for _, u := range candidates {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key))
+		_, _ = hash.Write([]byte(u.address))
+		score := hash.Sum64()
+		if selected == nil || score > selectedScore {
+			selected, selectedScore = u, score
+		}
+	}
+	return selected
+}
+
+// healthCheck 定期与每个服务端建立连接并完成socks5的认证协商，更新可用状态和延迟，直到ctx结束
+func (b *balancer) healthCheck(ctx context.Context, interval time.Duration) {
+	b.checkOnce(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.checkOnce(ctx)
+		}
+	}
+}
+
+func (b *balancer) checkOnce(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range b.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			start := time.Now()
+			err := b.server.probe(ctx, u)
+			if err != nil {
+				u.lock.Lock()
+				changed := u.healthy
+				u.healthy = false
+				u.lock.Unlock()
+				if changed {
+					logrus.Warnf("Health check of remote %s failed: %s", u.address, err.Error())
+				}
+				return
+			}
+
+			u.lock.Lock()
+			changed := !u.healthy
+			u.lock.Unlock()
+			u.checked(time.Since(start))
+			if changed {
+				logrus.Infof("Remote %s is healthy again", u.address)
+			}
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe 不经过多路复用会话，单独建立连接并完成TLS、WebSocket握手以及socks5的认证协商
+func (s *server) probe(ctx context.Context, u *upstream) error {
+	conn, err := s.dialRemote(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := s.negotiateWithin(conn, dialTimeout); err != nil {
+		return errors.Wrapf(err, "Socks5 negotiation with %s failed", u.address)
+	}
+	return nil
+}
+
+func (b *balancer) close() {
+	for _, u := range b.upstreams {
+		if u.muxPool != nil {
+			u.muxPool.close()
+		}
+	}
+}
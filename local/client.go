@@ -0,0 +1,122 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// replyError 请求被拒绝时返回的错误，rep为回复的状态码，需要原样告知本地应用
+type replyError struct {
+	rep uint8
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("Request rejected, reply: %v", e.rep)
+}
+
+// openSocks 选择服务端建立连接，并使用配置的用户名和密码完成socks5的认证协商，协商失败的服务端同样计入失败次数
+func (s *server) openSocks(ctx context.Context, key string) (net.Conn, *upstream, error) {
+	return s.balancer.open(ctx, key, true)
+}
+
+// openControl 与openSocks相同，但不经过多路复用会话，用于自身承载多路复用会话的反向隧道控制连接
+func (s *server) openControl(ctx context.Context, key string) (net.Conn, *upstream, error) {
+	return s.balancer.open(ctx, key, false)
+}
+
+// negotiateWithin 在timeout内完成协商，避免无响应的服务端阻塞连接或健康检查
+func (s *server) negotiateWithin(conn net.Conn, timeout time.Duration) error {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// negotiate 配置了用户名时同时提供无认证和用户名密码两种方式，由服务端选择
+func (s *server) negotiate(conn net.Conn) error {
+	methods := []byte{noAuth}
+	if len(s.config.Username) != 0 {
+		methods = append(methods, userPassAuth)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	selected := []byte{0, 0}
+	if _, err := io.ReadFull(conn, selected); err != nil {
+		return err
+	}
+	if selected[0] != socks5Version {
+		return errors.New(fmt.Sprintf("Unsupported socks version, expect %v, get %v", socks5Version, selected[0]))
+	}
+	switch selected[1] {
+	case noAuth:
+		return nil
+	case userPassAuth:
+		if len(s.config.Username) == 0 {
+			return errors.New("Remote requires username/password authentication")
+		}
+		return s.authenticate(conn)
+	case noAcceptableMethods:
+		return errors.New("No acceptable authentication method, check username and password of socks5-local")
+	default:
+		return errors.New(fmt.Sprintf("Unsupported authentication method: %v", selected[1]))
+	}
+}
+
+// authenticate 按照RFC 1929完成用户名密码的子协商
+func (s *server) authenticate(conn net.Conn) error {
+	username, password := s.config.Username, s.config.Password
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("Username and password must not be longer than 255 bytes")
+	}
+	msg := make([]byte, 0, 3+len(username)+len(password))
+	msg = append(msg, authVersion, byte(len(username)))
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	status := []byte{0, 0}
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return err
+	}
+	if status[1] != authSuccess {
+		return errors.New("Authentication failed, check username and password of socks5-local")
+	}
+	return nil
+}
+
+// request 发送请求并读取服务端的回复，返回服务端绑定的地址
+// 回复按字节精确读取，之后连接上的数据都属于目标地址
+func request(conn net.Conn, command uint8, dest *target) (*target, error) {
+	addr, err := encodeTarget(dest)
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte{socks5Version, command, 0}, addr...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, errors.New(fmt.Sprintf("Unsupported socks version, expect %v, get %v", socks5Version, header[0]))
+	}
+	if header[1] != succeeded {
+		return nil, &replyError{rep: header[1]}
+	}
+	return readTarget(conn)
+}
@@ -1,18 +1,129 @@
 package local
 
 import (
+	"fmt"
+	"math"
+	"net"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
 )
 
+const (
+	defaultListenAddress       = "127.0.0.1"
+	defaultMuxSessions         = 4
+	defaultHealthCheckInterval = 10
+	defaultFailureThreshold    = 3
+	defaultCircuitBreakTimeout = 30
+)
+
+// Remote 一个socks5服务端及其权重，权重未配置时为1
+type Remote struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
 type Config struct {
 	RemoteAddress string `json:"remote_address"`
 	Port          int    `json:"port"`
-	Username      string `json:"username"`
-	Password      string `json:"password"`
+
+	// 本地端口及DNS的监听地址，默认为127.0.0.1，为局域网提供代理时可以配置为0.0.0.0，此时应同时配置本地认证
+	ListenAddress string `json:"listen_address"`
+
+	// 向服务端认证时使用的用户名和密码
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// 本地应用连接socks5-local时使用的用户名和密码，为空时不需要认证
+	LocalUsername string `json:"local_username"`
+	LocalPassword string `json:"local_password"`
+
+	// 关闭后本地端口不再接受HTTP CONNECT请求，也不再提供PAC文件
+	DisableHTTP bool `json:"disable_http"`
+
+	// 透明代理的监听端口，为0时不开启，仅支持linux
+	TransparentPort int `json:"transparent_port"`
+
+	// 透明代理的模式，可选redirect（iptables REDIRECT）、tproxy（iptables TPROXY），默认为redirect
+	TransparentMode string `json:"transparent_mode"`
+
+	// 为客户端发出的连接设置的SO_MARK，为0时不设置，用于在iptables的OUTPUT链中排除客户端自身的流量，仅支持linux
+	TransparentMark int `json:"transparent_mark"`
+
+	// 静态端口转发，每条转发使用单独的本地监听地址
+	Forwards []Forward `json:"forwards"`
+
+	// 反向隧道，将服务端开放的端口转发到本地的服务
+	ReverseTunnels []ReverseTunnel `json:"reverse_tunnels"`
+
+	// 本地DNS的监听端口，同时监听UDP和TCP，查询经服务端解析，为0时不开启
+	DNSPort int `json:"dns_port"`
+
+	// 使用本地解析器解析的域名后缀，例如内网域名
+	DNSDirectDomains []string `json:"dns_direct_domains"`
+
+	// 本地解析器的地址，例如10.0.0.53:53，为空时使用系统解析器
+	DNSLocalServer string `json:"dns_local_server"`
+
+	// DNS缓存的最大条目数，默认为1024，小于0时不缓存
+	DNSCacheSize int `json:"dns_cache_size"`
+
+	// 本地端口上提供PAC文件的路径，默认为/proxy.pac
+	PACPath string `json:"pac_path"`
+
+	// 分流规则，按顺序匹配，第一条匹配的规则生效，都不匹配时使用default_route，默认为proxy
+	Routes       []Route `json:"routes"`
+	DefaultRoute string  `json:"default_route"`
+
+	// 网段规则需要匹配目的域名的IP时，默认经服务端解析以避免DNS泄露，为true时使用本地的系统解析器
+	RouteResolveLocal bool `json:"route_resolve_local"`
+
+	// 多个服务端，配置后忽略remote_address
+	Remotes []Remote `json:"remotes"`
+
+	// 负载均衡策略，可选round_robin、least_connections、lowest_latency、sticky，默认为round_robin
+	Strategy string `json:"strategy"`
+
+	// 健康检查的间隔（秒），默认为10，小于0时不进行健康检查
+	HealthCheckInterval int `json:"health_check_interval"`
+
+	// 连续连接失败多少次后熔断，以及熔断的时长（秒），默认为3次、30秒
+	FailureThreshold    int `json:"failure_threshold"`
+	CircuitBreakTimeout int `json:"circuit_break_timeout"`
+
+	// 与socks5-server之间的加密算法及预共享密钥，需要与服务端保持一致，为空时不加密
+	Cipher string `json:"cipher"`
+	Key    string `json:"key"`
+
+	// 到服务端的传输方式，可选tcp、tls、ws、wss，默认为tcp
+	Transport string `json:"transport"`
+
+	// ws、wss传输方式的请求路径，需要与服务端配置一致，默认为/
+	WebSocketPath string `json:"websocket_path"`
+
+	// TLS握手时使用的SNI，为空时使用服务端地址中的主机名
+	TLSServerName string `json:"tls_server_name"`
+
+	// 校验服务端证书的CA，为空时使用系统的根证书
+	TLSCA string `json:"tls_ca"`
+
+	// 服务端证书公钥的SHA-256指纹（base64），未配置CA时以指纹代替CA校验，CA的指纹需要服务端发送完整的证书链
+	TLSPins []string `json:"tls_pins"`
+
+	// 服务端要求双向认证时使用的客户端证书及私钥
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// 开启后在少量到服务端的长连接上多路复用所有本地连接
+	Mux bool `json:"mux"`
+
+	// 多路复用的最大会话数，以及会话的心跳间隔（秒）
+	MuxSessions  int `json:"mux_sessions"`
+	MuxKeepAlive int `json:"mux_keep_alive"`
 }
 
 func (c *Config) ReadFrom(configFilePath string) error {
@@ -28,12 +139,184 @@ func (c *Config) PrettyPrint(out *os.File) error {
 }
 
 func (c *Config) Precheck() error {
-	if len(c.RemoteAddress) == 0 {
+	if len(c.RemoteAddress) == 0 && len(c.Remotes) == 0 {
 		return errors.New("Remote address should not be nil")
 	}
+	for _, remote := range c.Remotes {
+		if _, _, err := net.SplitHostPort(remote.Address); err != nil {
+			return errors.Wrapf(err, "Invalid remote address[%s]", remote.Address)
+		}
+		if remote.Weight < 0 {
+			return errors.New(fmt.Sprintf("Weight of remote %s must not be negative", remote.Address))
+		}
+	}
+	switch c.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConnections, StrategyLowestLatency, StrategySticky:
+	default:
+		return errors.New(fmt.Sprintf("Unsupported strategy: %s", c.Strategy))
+	}
+	if c.TransparentPort < 0 || c.TransparentPort > 65535 || (c.TransparentPort != 0 && c.TransparentPort == c.Port) {
+		return errors.New("Transparent port must be a valid port different from the local port")
+	}
+	switch c.TransparentMode {
+	case "", TransparentRedirect, TransparentTProxy:
+	default:
+		return errors.New(fmt.Sprintf("Unsupported transparent mode: %s", c.TransparentMode))
+	}
+	if c.TransparentMark < 0 || int64(c.TransparentMark) > math.MaxUint32 {
+		return errors.New("Transparent mark must be a valid 32-bit mark")
+	}
+	listens := make(map[string]bool)
+	for _, forward := range c.Forwards {
+		if _, _, err := net.SplitHostPort(forward.Listen); err != nil {
+			return errors.Wrapf(err, "Invalid forward listen address[%s]", forward.Listen)
+		}
+		if listens[forward.Listen] {
+			return errors.New(fmt.Sprintf("Duplicate forward listen address: %s", forward.Listen))
+		}
+		listens[forward.Listen] = true
+		if _, err := parseTarget(forward.Target); err != nil {
+			return errors.Wrapf(err, "Invalid forward target[%s]", forward.Target)
+		}
+	}
+	for _, tunnel := range c.ReverseTunnels {
+		if tunnel.RemotePort <= 0 || tunnel.RemotePort > 65535 {
+			return errors.New(fmt.Sprintf("Invalid remote port of reverse tunnel: %d", tunnel.RemotePort))
+		}
+		if _, _, err := net.SplitHostPort(tunnel.Target); err != nil {
+			return errors.Wrapf(err, "Invalid reverse tunnel target[%s]", tunnel.Target)
+		}
+	}
+	if c.DNSPort < 0 || c.DNSPort > 65535 || (c.DNSPort != 0 && (c.DNSPort == c.Port || c.DNSPort == c.TransparentPort)) {
+		return errors.New("DNS port must be a valid port different from the local and transparent port")
+	}
+	if len(c.DNSLocalServer) != 0 {
+		if _, _, err := net.SplitHostPort(c.DNSLocalServer); err != nil {
+			return errors.Wrapf(err, "Invalid dns local server[%s]", c.DNSLocalServer)
+		}
+	}
+	switch c.DefaultRoute {
+	case "", RouteDirect, RouteProxy, RouteReject:
+	default:
+		return errors.New(fmt.Sprintf("Unknown route action: %s", c.DefaultRoute))
+	}
+	if _, err := compileRoutes(c.Routes); err != nil {
+		return err
+	}
+	if c.FailureThreshold < 0 || c.CircuitBreakTimeout < 0 {
+		return errors.New("Failure threshold and circuit break timeout must not be negative")
+	}
+
+	if len(c.Username) > 255 || len(c.Password) > 255 || len(c.LocalUsername) > 255 || len(c.LocalPassword) > 255 {
+		return errors.New("Username and password must not be longer than 255 bytes")
+	}
+	if len(c.LocalPassword) != 0 && len(c.LocalUsername) == 0 {
+		return errors.New("Local username should not be empty when local password is set")
+	}
+	if len(c.ListenAddress) != 0 && net.ParseIP(c.ListenAddress) == nil {
+		return errors.New(fmt.Sprintf("Listen address must be an ip: %s", c.ListenAddress))
+	}
 
 	if c.Port < 1024 {
 		return errors.New("Port must be greater than 1024")
 	}
+
+	if len(c.Key) != 0 {
+		if err := proxy.CheckCipher(c.Cipher, c.Key); err != nil {
+			return err
+		}
+	}
+
+	if err := checkTransport(c.Transport); err != nil {
+		return err
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		return errors.New("Both tls certificate and key are required")
+	}
+	if c.MuxSessions < 0 || c.MuxKeepAlive < 0 {
+		return errors.New("Mux sessions and keep alive must not be negative")
+	}
 	return nil
 }
+
+// GetRemotes 未配置remotes时以remote_address作为唯一的服务端
+func (c *Config) GetRemotes() []Remote {
+	if len(c.Remotes) == 0 {
+		return []Remote{{Address: c.RemoteAddress, Weight: 1}}
+	}
+	return c.Remotes
+}
+
+func (c *Config) GetListenAddress() string {
+	if len(c.ListenAddress) == 0 {
+		return defaultListenAddress
+	}
+	return c.ListenAddress
+}
+
+func (c *Config) GetDefaultRoute() string {
+	if len(c.DefaultRoute) == 0 {
+		return RouteProxy
+	}
+	return c.DefaultRoute
+}
+
+func (c *Config) GetHealthCheckInterval() time.Duration {
+	if c.HealthCheckInterval == 0 {
+		return defaultHealthCheckInterval * time.Second
+	}
+	return time.Duration(c.HealthCheckInterval) * time.Second
+}
+
+func (c *Config) GetFailureThreshold() int {
+	if c.FailureThreshold == 0 {
+		return defaultFailureThreshold
+	}
+	return c.FailureThreshold
+}
+
+func (c *Config) GetCircuitBreakTimeout() time.Duration {
+	if c.CircuitBreakTimeout == 0 {
+		return defaultCircuitBreakTimeout * time.Second
+	}
+	return time.Duration(c.CircuitBreakTimeout) * time.Second
+}
+
+func (c *Config) GetMuxSessions() int {
+	if c.MuxSessions == 0 {
+		return defaultMuxSessions
+	}
+	return c.MuxSessions
+}
+
+func (c *Config) GetMuxKeepAlive() time.Duration {
+	return time.Duration(c.MuxKeepAlive) * time.Second
+}
+
+func (c *Config) GetTransparentMode() string {
+	if len(c.TransparentMode) == 0 {
+		return TransparentRedirect
+	}
+	return c.TransparentMode
+}
+
+func (c *Config) GetDNSCacheSize() int {
+	if c.DNSCacheSize == 0 {
+		return defaultDNSCacheSize
+	}
+	return c.DNSCacheSize
+}
+
+func (c *Config) GetPACPath() string {
+	if len(c.PACPath) == 0 {
+		return defaultPACPath
+	}
+	return c.PACPath
+}
+
+func (c *Config) GetWebSocketPath() string {
+	if len(c.WebSocketPath) == 0 {
+		return defaultWebSocketPath
+	}
+	return c.WebSocketPath
+}
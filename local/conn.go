@@ -0,0 +1,26 @@
+package local
+
+import (
+	"net"
+	"sync"
+)
+
+// upstreamConn 经由某个服务端的连接，关闭时释放该服务端的连接计数
+type upstreamConn struct {
+	net.Conn
+	upstream *upstream
+	once     sync.Once
+}
+
+func (c *upstreamConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+func (c *upstreamConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.upstream.release)
+	return err
+}
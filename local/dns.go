@@ -0,0 +1,654 @@
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+)
+
+const (
+	// 单次查询的超时时间，以及TCP查询连接的空闲超时
+	dnsTimeout     = 5 * time.Second
+	dnsIdleTimeout = 10 * time.Second
+
+	// 保留的空闲DNS over tunnel连接数
+	dnsMaxIdleConns = 4
+
+	// 同时处理的UDP查询数以及TCP连接数，超过时丢弃查询或关闭连接
+	dnsMaxConcurrentQueries = 256
+	dnsMaxTCPConns          = 64
+
+	// NXDOMAIN以及没有应答记录时的缓存时间
+	dnsNegativeTTL = 30 * time.Second
+
+	// 系统解析器不提供TTL，本地解析的应答使用固定的TTL（秒）
+	dnsAnswerTTL = 60
+
+	defaultDNSCacheSize = 1024
+
+	dnsUDPBufferSize = 4096
+
+	// 查询不带EDNS时UDP应答的最大长度
+	dnsMinUDPSize = 512
+)
+
+// listenDNS 在同一端口上同时监听UDP和TCP的DNS查询，监听地址与本地端口相同，避免成为开放的解析器
+func (s *server) listenDNS(ctx context.Context) {
+	forwarder := s.dns
+	address := net.JoinHostPort(s.config.GetListenAddress(), strconv.Itoa(s.config.DNSPort))
+
+	listenConfig := net.ListenConfig{}
+	packetConn, err := listenConfig.ListenPacket(ctx, "udp", address)
+	if err != nil {
+		logrus.Errorf("Error occured while listen dns port: %s", err.Error())
+		return
+	}
+	listener, err := listenConfig.Listen(ctx, socks5.Tcp, address)
+	if err != nil {
+		_ = packetConn.Close()
+		logrus.Errorf("Error occured while listen dns port: %s", err.Error())
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = packetConn.Close()
+		_ = listener.Close()
+	}()
+	logrus.Infof("DNS forwarder listening on %s", listener.Addr().String())
+
+	go s.serveDNSTCP(ctx, listener, forwarder)
+	s.serveDNSUDP(ctx, packetConn, forwarder)
+}
+
+// serveDNSUDP 并发查询数达到上限时丢弃新的查询，客户端超时后会重试
+func (s *server) serveDNSUDP(ctx context.Context, conn net.PacketConn, forwarder *dnsForwarder) {
+	semaphore := make(chan struct{}, dnsMaxConcurrentQueries)
+	for {
+		buf := make([]byte, dnsUDPBufferSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Errorf("Error occured while read dns query: %s", err.Error())
+			continue
+		}
+
+		select {
+		case semaphore <- struct{}{}:
+		default:
+			logrus.Debugf("Too many dns queries, drop query from %s", addr.String())
+			continue
+		}
+		go func() {
+			defer func() {
+				<-semaphore
+			}()
+			answer, err := forwarder.exchange(ctx, buf[:n])
+			if err != nil {
+				logrus.Errorf("Error occoured while resolve dns query from %s: %s", addr.String(), err.Error())
+				if answer, err = serverFailure(buf[:n]); err != nil {
+					return
+				}
+			}
+			if answer, err = truncateUDP(buf[:n], answer); err != nil {
+				logrus.Errorf("Error occoured while truncate dns answer for %s: %s", addr.String(), err.Error())
+				return
+			}
+			_, _ = conn.WriteTo(answer, addr)
+		}()
+	}
+}
+
+// serveDNSTCP 连接数达到上限时直接关闭新的连接
+func (s *server) serveDNSTCP(ctx context.Context, listener net.Listener, forwarder *dnsForwarder) {
+	semaphore := make(chan struct{}, dnsMaxTCPConns)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Errorf("Error occured while accept tcp: %s", err.Error())
+			continue
+		}
+		select {
+		case semaphore <- struct{}{}:
+		default:
+			logrus.Debugf("Too many dns connections, close connection from %s", conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+
+		go func() {
+			defer func() {
+				_ = conn.Close()
+				<-semaphore
+			}()
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+				query, err := proxy.ReadDNSMessage(conn)
+				if err != nil {
+					return
+				}
+				answer, err := forwarder.exchange(ctx, query)
+				if err != nil {
+					logrus.Errorf("Error occoured while resolve dns query from %s: %s", conn.RemoteAddr().String(), err.Error())
+					if answer, err = serverFailure(query); err != nil {
+						return
+					}
+				}
+				if err := proxy.WriteDNSMessage(conn, answer); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// truncateUDP 应答超过查询允许的UDP长度（没有EDNS时为512字节）时只保留问题部分并设置TC，客户端随后改用TCP查询
+func truncateUDP(query []byte, answer []byte) ([]byte, error) {
+	limit := udpPayloadSize(query)
+	if len(answer) <= limit {
+		return answer, nil
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(answer)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	header.Truncated = true
+	response := dnsmessage.Message{Header: header, Questions: questions}
+	truncated, err := response.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if len(truncated) > limit {
+		return nil, errors.New(fmt.Sprintf("Truncated dns answer exceeds %d bytes", limit))
+	}
+	return truncated, nil
+}
+
+// udpPayloadSize 返回查询的OPT记录中声明的UDP长度，不小于512字节，也不超过本地的接收缓冲区
+func udpPayloadSize(query []byte) int {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return dnsMinUDPSize
+	}
+	for {
+		resourceHeader, err := parser.AdditionalHeader()
+		if err != nil {
+			return dnsMinUDPSize
+		}
+		if resourceHeader.Type != dnsmessage.TypeOPT {
+			if err := parser.SkipAdditional(); err != nil {
+				return dnsMinUDPSize
+			}
+			continue
+		}
+		size := int(resourceHeader.Class)
+		switch {
+		case size < dnsMinUDPSize:
+			return dnsMinUDPSize
+		case size > dnsUDPBufferSize:
+			return dnsUDPBufferSize
+		}
+		return size
+	}
+}
+
+// serverFailure 解析失败时回复SERVFAIL，避免客户端等待超时
+func serverFailure(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              dnsmessage.RCodeServerFailure,
+		},
+		Questions: questions,
+	}
+	return response.Pack()
+}
+
+// dnsForwarder 内网等指定的域名交给本地解析器，其余查询经服务端解析，应答按照TTL缓存
+type dnsForwarder struct {
+	server   *server
+	suffixes []string
+	cache    *dnsCache
+
+	lock sync.Mutex
+	idle []net.Conn
+}
+
+func newDNSForwarder(s *server) *dnsForwarder {
+	f := &dnsForwarder{
+		server: s,
+		cache:  &dnsCache{size: s.config.GetDNSCacheSize(), entries: make(map[string]*dnsCacheEntry)},
+	}
+	for _, domain := range s.config.DNSDirectDomains {
+		f.suffixes = append(f.suffixes, normalizeDomain(domain))
+	}
+	return f
+}
+
+func (f *dnsForwarder) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := normalizeDomain(question.Name.String())
+	key := fmt.Sprintf("%s/%s", name, question.Type.String())
+	if answer := f.cache.get(key, header.ID); answer != nil {
+		return answer, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var answer []byte
+	if f.direct(name) {
+		logrus.Debugf("Resolve %s %s with local resolver", name, question.Type.String())
+		answer, err = f.exchangeLocal(ctx, query)
+	} else {
+		logrus.Debugf("Resolve %s %s via remote", name, question.Type.String())
+		answer, err = f.exchangeTunnel(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.cache.put(key, answer)
+	return answer, nil
+}
+
+type lookupResult struct {
+	ips []net.IP
+	err error
+}
+
+// lookup 同时查询A和AAAA记录，与本地DNS的查询相同，经服务端或本地解析器解析并使用同一缓存
+func (f *dnsForwarder) lookup(ctx context.Context, name string) ([]net.IP, error) {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan *lookupResult, len(types))
+	for _, qtype := range types {
+		go func(qtype dnsmessage.Type) {
+			ips, err := f.lookupType(ctx, name, qtype)
+			results <- &lookupResult{ips: ips, err: err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var lastErr error
+	for range types {
+		result := <-results
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		ips = append(ips, result.ips...)
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+func (f *dnsForwarder) lookupType(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	query, err := proxy.NewDNSQuery(name, qtype, binary.BigEndian.Uint16(id))
+	if err != nil {
+		return nil, err
+	}
+	answer, err := f.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	ips, _, rcode, err := proxy.ParseDNSAnswer(answer)
+	if err != nil {
+		return nil, err
+	}
+	if rcode != dnsmessage.RCodeSuccess {
+		return nil, errors.New(fmt.Sprintf("DNS query for %s returned %s", name, rcode.String()))
+	}
+	return ips, nil
+}
+
+func (f *dnsForwarder) direct(name string) bool {
+	for _, suffix := range f.suffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeLocal 配置了本地解析器时转发原始报文，应答被截断时改用TCP，否则使用系统解析器
+func (f *dnsForwarder) exchangeLocal(ctx context.Context, query []byte) ([]byte, error) {
+	address := f.server.config.DNSLocalServer
+	if len(address) == 0 {
+		return proxy.AnswerDNS(ctx, query, lookupLocal, nil, dnsAnswerTTL)
+	}
+
+	dialer := f.server.dialer(0)
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	// ID与查询不一致的报文可能是伪造或过期的应答，丢弃后继续等待直到超时
+	buf := make([]byte, 0xffff)
+	var header dnsmessage.Header
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var parser dnsmessage.Parser
+		if header, err = parser.Start(buf[:n]); err != nil || n < 2 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(query) {
+			logrus.Debugf("Drop mismatched dns answer from %s", address)
+			continue
+		}
+		buf = buf[:n]
+		break
+	}
+	if !header.Truncated {
+		return buf, nil
+	}
+
+	tcpConn, err := dialer.DialContext(ctx, socks5.Tcp, address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tcpConn.Close()
+	}()
+	return roundTrip(ctx, tcpConn, query)
+}
+
+// exchangeTunnel 空闲连接可能已被服务端关闭，失败时使用新的连接重试一次
+func (f *dnsForwarder) exchangeTunnel(ctx context.Context, query []byte) ([]byte, error) {
+	if conn := f.get(); conn != nil {
+		answer, err := roundTrip(ctx, conn, query)
+		if err == nil {
+			f.put(conn)
+			return answer, nil
+		}
+		_ = conn.Close()
+	}
+
+	conn, err := f.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := roundTrip(ctx, conn, query)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	f.put(conn)
+	return answer, nil
+}
+
+func (f *dnsForwarder) open(ctx context.Context) (net.Conn, error) {
+	conn, u, err := f.server.openSocks(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := request(conn, proxy.DNSCommand, &target{IP: net.IPv4zero}); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "DNS request via %s failed", u.address)
+	}
+	return conn, nil
+}
+
+func (f *dnsForwarder) get() net.Conn {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.idle) == 0 {
+		return nil
+	}
+	conn := f.idle[len(f.idle)-1]
+	f.idle = f.idle[:len(f.idle)-1]
+	return conn
+}
+
+func (f *dnsForwarder) put(conn net.Conn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.idle) >= dnsMaxIdleConns {
+		_ = conn.Close()
+		return
+	}
+	f.idle = append(f.idle, conn)
+}
+
+func (f *dnsForwarder) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, conn := range f.idle {
+		_ = conn.Close()
+	}
+	f.idle = nil
+}
+
+// roundTrip 在TCP格式的连接上发送一个查询并读取应答
+func roundTrip(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+	}
+	if err := proxy.WriteDNSMessage(conn, query); err != nil {
+		return nil, err
+	}
+	answer, err := proxy.ReadDNSMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 || binary.BigEndian.Uint16(answer) != binary.BigEndian.Uint16(query) {
+		return nil, errors.New("Mismatched dns answer id")
+	}
+	return answer, nil
+}
+
+func lookupLocal(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, 0, nil
+}
+
+type dnsCacheEntry struct {
+	answer []byte
+	stored time.Time
+	expire time.Time
+}
+
+// dnsCache 以域名和查询类型为键缓存应答，达到上限时先淘汰过期的条目
+type dnsCache struct {
+	size int
+
+	lock    sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+// get 返回未过期的应答，应答的ID替换为本次查询的ID，记录的TTL减去在缓存中经过的时间
+func (c *dnsCache) get(key string, id uint16) []byte {
+	if c.size <= 0 {
+		return nil
+	}
+	c.lock.Lock()
+	entry, exist := c.entries[key]
+	if exist && time.Now().After(entry.expire) {
+		delete(c.entries, key)
+		exist = false
+	}
+	c.lock.Unlock()
+	if !exist {
+		return nil
+	}
+
+	answer, err := agedAnswer(entry.answer, time.Since(entry.stored))
+	if err != nil {
+		return nil
+	}
+	binary.BigEndian.PutUint16(answer, id)
+	return answer
+}
+
+// agedAnswer 复制应答并将其中每条记录的TTL减去elapsed，OPT记录的TTL字段另有含义，保持不变
+func agedAnswer(answer []byte, elapsed time.Duration) ([]byte, error) {
+	seconds := uint32(elapsed / time.Second)
+	if seconds == 0 {
+		return append([]byte{}, answer...), nil
+	}
+
+	var message dnsmessage.Message
+	if err := message.Unpack(answer); err != nil {
+		return nil, err
+	}
+	for _, section := range [][]dnsmessage.Resource{message.Answers, message.Authorities, message.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if section[i].Header.TTL > seconds {
+				section[i].Header.TTL -= seconds
+			} else {
+				section[i].Header.TTL = 0
+			}
+		}
+	}
+	return message.Pack()
+}
+
+func (c *dnsCache) put(key string, answer []byte) {
+	if c.size <= 0 {
+		return
+	}
+	ttl, ok := answerTTL(answer)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if _, exist := c.entries[key]; !exist && len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if now.After(entry.expire) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{answer: append([]byte{}, answer...), stored: now, expire: now.Add(ttl)}
+}
+
+// answerTTL 成功的应答按照应答记录中最小的TTL缓存，NXDOMAIN及没有应答记录时使用固定的缓存时间，其他应答不缓存
+func answerTTL(answer []byte) (time.Duration, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(answer)
+	if err != nil || header.Truncated {
+		return 0, false
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeNameError:
+		return dnsNegativeTTL, true
+	case dnsmessage.RCodeSuccess:
+	default:
+		return 0, false
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+
+	minTTL := -1
+	for {
+		resourceHeader, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return 0, false
+		}
+		if minTTL < 0 || int(resourceHeader.TTL) < minTTL {
+			minTTL = int(resourceHeader.TTL)
+		}
+		if err := parser.SkipAnswer(); err != nil {
+			return 0, false
+		}
+	}
+	if minTTL < 0 {
+		return dnsNegativeTTL, true
+	}
+	return time.Duration(minTTL) * time.Second, true
+}
@@ -0,0 +1,284 @@
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+)
+
+// fakeUpstream 本地解析器的替身，big.test返回超过512字节的应答，spoof.test先返回一个ID不一致的应答
+type fakeUpstream struct {
+	address string
+	queries int32
+}
+
+func startFakeUpstream(t *testing.T) *fakeUpstream {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen udp failed: %v", err)
+	}
+	listener, err := net.Listen(socks5.Tcp, packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Listen tcp failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = packetConn.Close()
+		_ = listener.Close()
+	})
+
+	upstream := &fakeUpstream{address: packetConn.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 0xffff)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&upstream.queries, 1)
+			query := append([]byte{}, buf[:n]...)
+			if name := queryName(query); name == "spoof.test." {
+				spoofed := append([]byte{}, query...)
+				binary.BigEndian.PutUint16(spoofed, binary.BigEndian.Uint16(query)+1)
+				_, _ = packetConn.WriteTo(fakeAnswer(t, spoofed, net.IPv4(6, 6, 6, 6), 1), addr)
+			}
+			_, _ = packetConn.WriteTo(upstreamAnswer(t, query), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				query, err := proxy.ReadDNSMessage(conn)
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&upstream.queries, 1)
+				_ = proxy.WriteDNSMessage(conn, upstreamAnswer(t, query))
+			}()
+		}
+	}()
+	return upstream
+}
+
+func upstreamAnswer(t *testing.T, query []byte) []byte {
+	if queryName(query) == "big.test." {
+		return fakeAnswer(t, query, net.IPv4(10, 0, 0, 1), 60)
+	}
+	return fakeAnswer(t, query, net.IPv4(10, 0, 0, 2), 1)
+}
+
+func queryName(query []byte) string {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return ""
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return ""
+	}
+	return question.Name.String()
+}
+
+// fakeAnswer 以count条相同TTL的A记录回复查询
+func fakeAnswer(t *testing.T, query []byte, ip net.IP, count int) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("Unpack query failed: %v", err)
+		return nil
+	}
+	msg.Response = true
+	msg.Additionals = nil
+	for i := 0; i < count; i++ {
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip.To4())
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &a,
+		})
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		t.Errorf("Pack answer failed: %v", err)
+	}
+	return answer
+}
+
+// startDNS 启动本地DNS监听，test.及其子域名交给fakeUpstream解析
+func startDNS(t *testing.T) (*fakeUpstream, string) {
+	upstream := startFakeUpstream(t)
+	s := &server{config: &Config{DNSDirectDomains: []string{"test"}, DNSLocalServer: upstream.address}}
+	s.dns = newDNSForwarder(s)
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen udp failed: %v", err)
+	}
+	listener, err := net.Listen(socks5.Tcp, packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Listen tcp failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		_ = packetConn.Close()
+		_ = listener.Close()
+	})
+	go s.serveDNSUDP(ctx, packetConn, s.dns)
+	go s.serveDNSTCP(ctx, listener, s.dns)
+	return upstream, packetConn.LocalAddr().String()
+}
+
+func newQuery(t *testing.T, name string, id uint16, udpSize uint16) []byte {
+	query, err := proxy.NewDNSQuery(name, dnsmessage.TypeA, id)
+	if err != nil {
+		t.Fatalf("New dns query failed: %v", err)
+	}
+	if udpSize == 0 {
+		return query
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Fatalf("Unpack query failed: %v", err)
+	}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeOPT, Class: dnsmessage.Class(udpSize)},
+		Body:   &dnsmessage.OPTResource{},
+	})
+	if query, err = msg.Pack(); err != nil {
+		t.Fatalf("Pack query failed: %v", err)
+	}
+	return query
+}
+
+func exchangeDNS(t *testing.T, network string, address string, query []byte) (int, *dnsmessage.Message) {
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		t.Fatalf("Dial %s failed: %v", address, err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	var answer []byte
+	if network == socks5.Tcp {
+		if err := proxy.WriteDNSMessage(conn, query); err != nil {
+			t.Fatalf("Write query failed: %v", err)
+		}
+		answer, err = proxy.ReadDNSMessage(conn)
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatalf("Write query failed: %v", err)
+		}
+		buf := make([]byte, 0xffff)
+		var n int
+		n, err = conn.Read(buf)
+		answer = buf[:n]
+	}
+	if err != nil {
+		t.Fatalf("Read answer failed: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		t.Fatalf("Unpack answer failed: %v", err)
+	}
+	return len(answer), &msg
+}
+
+func TestDNSListener(t *testing.T) {
+	upstream, address := startDNS(t)
+
+	for _, item := range []struct {
+		name      string
+		network   string
+		udpSize   uint16
+		truncated bool
+		answers   int
+		ip        net.IP
+	}{
+		{name: "a.test", network: "udp", answers: 1, ip: net.IPv4(10, 0, 0, 2)},
+		{name: "a.test", network: socks5.Tcp, answers: 1, ip: net.IPv4(10, 0, 0, 2)},
+		{name: "spoof.test", network: "udp", answers: 1, ip: net.IPv4(10, 0, 0, 2)},
+		{name: "big.test", network: "udp", truncated: true},
+		{name: "big.test", network: "udp", udpSize: 4096, answers: 60, ip: net.IPv4(10, 0, 0, 1)},
+		{name: "big.test", network: socks5.Tcp, answers: 60, ip: net.IPv4(10, 0, 0, 1)},
+	} {
+		id := uint16(atomic.LoadInt32(&upstream.queries) + 100)
+		size, answer := exchangeDNS(t, item.network, address, newQuery(t, item.name, id, item.udpSize))
+		if answer.ID != id || !answer.Response {
+			t.Fatalf("Unexpected answer header for %s over %s: %+v", item.name, item.network, answer.Header)
+		}
+		if answer.Truncated != item.truncated || len(answer.Answers) != item.answers {
+			t.Fatalf("Unexpected answer for %s over %s: truncated %v, %d answers", item.name, item.network, answer.Truncated, len(answer.Answers))
+		}
+		if item.truncated && size > dnsMinUDPSize {
+			t.Fatalf("Truncated answer for %s is %d bytes", item.name, size)
+		}
+		for _, resource := range answer.Answers {
+			if ip := net.IP(resource.Body.(*dnsmessage.AResource).A[:]); !ip.Equal(item.ip) {
+				t.Fatalf("Unexpected address %s for %s, expect %s", ip, item.name, item.ip)
+			}
+		}
+	}
+
+	// a.test及big.test的应答已经缓存，再次查询不会发往上游
+	queries := atomic.LoadInt32(&upstream.queries)
+	exchangeDNS(t, "udp", address, newQuery(t, "a.test", 1, 0))
+	exchangeDNS(t, socks5.Tcp, address, newQuery(t, "big.test", 2, 0))
+	if current := atomic.LoadInt32(&upstream.queries); current != queries {
+		t.Fatalf("Cached answers sent to upstream, %d queries, expect %d", current, queries)
+	}
+}
+
+func TestDNSCacheAge(t *testing.T) {
+	cache := &dnsCache{size: 1, entries: make(map[string]*dnsCacheEntry)}
+	cache.put("a.test./A", fakeAnswer(t, newQuery(t, "a.test", 1, 0), net.IPv4(10, 0, 0, 2), 2))
+
+	for _, item := range []struct {
+		elapsed time.Duration
+		ttl     uint32
+	}{
+		{elapsed: 0, ttl: 300},
+		{elapsed: 100 * time.Second, ttl: 200},
+		{elapsed: 299 * time.Second, ttl: 1},
+		{elapsed: 301 * time.Second},
+	} {
+		entry := cache.entries["a.test./A"]
+		entry.stored = time.Now().Add(-item.elapsed)
+		entry.expire = entry.stored.Add(300 * time.Second)
+
+		answer := cache.get("a.test./A", 7)
+		if item.ttl == 0 {
+			if answer != nil {
+				t.Fatalf("Expired answer returned after %s", item.elapsed)
+			}
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(answer); err != nil {
+			t.Fatalf("Unpack cached answer failed: %v", err)
+		}
+		if msg.ID != 7 {
+			t.Fatalf("Unexpected cached answer id %d, expect 7", msg.ID)
+		}
+		for _, resource := range msg.Answers {
+			if resource.Header.TTL != item.ttl {
+				t.Fatalf("Unexpected ttl %d after %s, expect %d", resource.Header.TTL, item.elapsed, item.ttl)
+			}
+		}
+	}
+}
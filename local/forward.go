@@ -0,0 +1,78 @@
+package local
+
+import (
+	"context"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+)
+
+// Forward 静态端口转发，本地监听地址上的连接总是经服务端转发到固定的目的地址，类似ssh -L
+type Forward struct {
+	// 本地监听地址，例如127.0.0.1:5433，主机为空时监听所有网卡
+	Listen string `json:"listen"`
+
+	// 目的地址，例如db.internal:5432，由服务端解析及连接
+	Target string `json:"target"`
+}
+
+// listenForwards 为每条转发分别监听，任一监听失败不影响其他转发
+func (s *server) listenForwards(ctx context.Context) {
+	for i := range s.config.Forwards {
+		forward := s.config.Forwards[i]
+		dest, err := parseTarget(forward.Target)
+		if err != nil {
+			logrus.Errorf("Invalid forward target %s: %s", forward.Target, err.Error())
+			continue
+		}
+		go s.listenForward(ctx, forward.Listen, dest)
+	}
+}
+
+func (s *server) listenForward(ctx context.Context, address string, dest *target) {
+	listenConfig := net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, socks5.Tcp, address)
+	if err != nil {
+		logrus.Errorf("Error occured while listen forward %s: %s", address, err.Error())
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	logrus.Infof("Forwarding %s to %s", listener.Addr().String(), dest.Address())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			logrus.Errorf("Error occured while accept tcp: %s", err.Error())
+			continue
+		}
+
+		go s.handleForward(ctx, conn, dest)
+	}
+}
+
+// handleForward 不经过分流规则，总是通过服务端的CONNECT请求连接目的地址
+func (s *server) handleForward(ctx context.Context, conn net.Conn, dest *target) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	remote, _, err := s.connect(ctx, dest)
+	if err != nil {
+		logrus.Errorf("Error occoured while connect to %s: %s", dest.Address(), err.Error())
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	s.relay(conn, remote)
+}
@@ -0,0 +1,144 @@
+package local
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5/proxy"
+)
+
+// muxPool 维护少量到某个服务端的长连接会话，每个本地连接作为会话中的一条逻辑连接
+type muxPool struct {
+	server   *server
+	upstream *upstream
+	size     int
+	config   *yamux.Config
+
+	lock     sync.Mutex
+	sessions []*proxy.MuxSession
+
+	// 正在建立的会话数，与已建立的会话一起计入上限，每个会话建立结束后关闭dialed
+	pending int
+	dialed  chan struct{}
+	closed  bool
+}
+
+func newMuxPool(s *server, u *upstream) *muxPool {
+	return &muxPool{
+		server:   s,
+		upstream: u,
+		size:     s.config.GetMuxSessions(),
+		config:   proxy.NewMuxConfig(s.config.GetMuxKeepAlive()),
+		dialed:   make(chan struct{}),
+	}
+}
+
+// open 在负载最低的会话上打开逻辑连接，会话失效时重新建立一次
+func (p *muxPool) open(ctx context.Context) (net.Conn, error) {
+	session, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err == nil {
+		return stream, nil
+	}
+
+	_ = session.Close()
+	session, err = p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.Open()
+}
+
+// get 选择逻辑连接最少的会话，所有会话都在使用且未达到上限时建立新的会话
+// 建立会话前在锁内预留名额，拨号及握手时不持有锁，避免一个慢的服务端阻塞其他连接
+func (p *muxPool) get(ctx context.Context) (*proxy.MuxSession, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, errors.New("Mux pool is closed")
+		}
+		var selected *proxy.MuxSession
+		alive := p.sessions[:0]
+		for _, session := range p.sessions {
+			if session.IsClosed() {
+				continue
+			}
+			alive = append(alive, session)
+			if selected == nil || session.NumStreams() < selected.NumStreams() {
+				selected = session
+			}
+		}
+		p.sessions = alive
+
+		full := len(p.sessions)+p.pending >= p.size
+		if selected != nil && (selected.NumStreams() == 0 || full) {
+			p.lock.Unlock()
+			return selected, nil
+		}
+		if !full {
+			p.pending++
+			p.lock.Unlock()
+			return p.publish(p.dial(ctx))
+		}
+
+		// 没有可用的会话且名额都被正在建立的会话占用，等待其中之一完成
+		dialed := p.dialed
+		p.lock.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// publish 释放预留的名额，会话建立成功时加入连接池，并唤醒等待的连接
+func (p *muxPool) publish(session *proxy.MuxSession, err error) (*proxy.MuxSession, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	if p.closed {
+		_ = session.Close()
+		return nil, errors.New("Mux pool is closed")
+	}
+	p.sessions = append(p.sessions, session)
+	return session, nil
+}
+
+func (p *muxPool) dial(ctx context.Context) (*proxy.MuxSession, error) {
+	conn, err := p.server.dialRemote(ctx, p.upstream)
+	if err != nil {
+		return nil, err
+	}
+	session, err := proxy.NewMuxClient(conn, p.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (p *muxPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	for _, session := range p.sessions {
+		_ = session.Close()
+	}
+	p.sessions = nil
+}
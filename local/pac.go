@@ -0,0 +1,145 @@
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	defaultPACPath = "/proxy.pac"
+
+	pacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// pacRoute 分流规则在PAC中的表示，IPv4网段编码为[网络地址, 掩码]以便快速匹配
+type pacRoute struct {
+	Direct   bool        `json:"direct"`
+	Domains  []string    `json:"domains"`
+	Keywords []string    `json:"keywords"`
+	Nets4    [][2]uint32 `json:"nets4"`
+	Nets6    []string    `json:"nets6"`
+	Ports    [][2]int    `json:"ports"`
+}
+
+// pacScript 浏览器按照PAC中的规则决定直连或使用socks5-local，reject同样交给socks5-local处理
+const pacScript = `// Generated by socks5-local, regenerate after changing the routes
+var proxy = %s;
+var routes = %s;
+var defaultDirect = %t;
+
+function ip4(ip) {
+  var p = ip.split(".");
+  return (+p[0]) * 16777216 + ((+p[1]) << 16) + ((+p[2]) << 8) + (+p[3]);
+}
+
+function urlPort(url) {
+  var m = url.match(/^([a-z0-9+.-]+):\/\/(\[[^\]]*\]|[^\/:?#]*)(:(\d+))?/i);
+  if (m && m[4]) return +m[4];
+  if (m && (m[1].toLowerCase() === "https" || m[1].toLowerCase() === "wss")) return 443;
+  return 80;
+}
+
+function matchRoute(r, host, port, resolve) {
+  var i;
+  if (r.ports.length) {
+    var portMatched = false;
+    for (i = 0; i < r.ports.length; i++) {
+      if (port >= r.ports[i][0] && port <= r.ports[i][1]) { portMatched = true; break; }
+    }
+    if (!portMatched) return false;
+  }
+  if (!r.domains.length && !r.keywords.length && !r.nets4.length && !r.nets6.length) return true;
+  for (i = 0; i < r.domains.length; i++) {
+    if (host === r.domains[i] || dnsDomainIs(host, "." + r.domains[i])) return true;
+  }
+  for (i = 0; i < r.keywords.length; i++) {
+    if (host.indexOf(r.keywords[i]) >= 0) return true;
+  }
+  if (r.nets4.length || r.nets6.length) {
+    var ip = resolve();
+    if (!ip) return false;
+    if (ip.indexOf(":") < 0) {
+      var n = ip4(ip);
+      for (i = 0; i < r.nets4.length; i++) {
+        if (((n & r.nets4[i][1]) >>> 0) === r.nets4[i][0]) return true;
+      }
+    } else if (typeof isInNetEx === "function") {
+      for (i = 0; i < r.nets6.length; i++) {
+        if (isInNetEx(ip, r.nets6[i])) return true;
+      }
+    }
+  }
+  return false;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase().replace(/\.$/, "");
+  var port = urlPort(url);
+  var resolved = false, ip = null;
+  var resolve = function () {
+    if (!resolved) {
+      resolved = true;
+      ip = /^[0-9.]+$/.test(host) || host.indexOf(":") >= 0 ? host : dnsResolve(host);
+    }
+    return ip;
+  };
+  for (var i = 0; i < routes.length; i++) {
+    if (matchRoute(routes[i], host, port, resolve)) return routes[i].direct ? "DIRECT" : proxy;
+  }
+  return defaultDirect ? "DIRECT" : proxy;
+}
+`
+
+// GeneratePAC 根据分流规则生成PAC文件，host为浏览器访问socks5-local时使用的地址
+func GeneratePAC(config *Config, host string) ([]byte, error) {
+	routes, err := compileRoutes(config.Routes)
+	if err != nil {
+		return nil, err
+	}
+	return generatePAC(routes, config.GetDefaultRoute(), net.JoinHostPort(host, strconv.Itoa(config.Port)))
+}
+
+func generatePAC(routes []*Route, defaultAction string, address string) ([]byte, error) {
+	pacRoutes := make([]pacRoute, 0, len(routes))
+	for _, route := range routes {
+		pacRoutes = append(pacRoutes, newPACRoute(route))
+	}
+	encodedRoutes, err := json.Marshal(pacRoutes)
+	if err != nil {
+		return nil, err
+	}
+	encodedProxy, err := json.Marshal("SOCKS5 " + address)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, pacScript, encodedProxy, encodedRoutes, defaultAction == RouteDirect)
+	return buf.Bytes(), nil
+}
+
+func newPACRoute(route *Route) pacRoute {
+	r := pacRoute{
+		Direct:   route.Action == RouteDirect,
+		Domains:  append([]string{}, route.suffixes...),
+		Keywords: append([]string{}, route.keywords...),
+		Nets4:    [][2]uint32{},
+		Nets6:    []string{},
+		Ports:    [][2]int{},
+	}
+	for _, network := range route.networks {
+		if ip := network.IP.To4(); ip != nil && len(network.Mask) == net.IPv4len {
+			r.Nets4 = append(r.Nets4, [2]uint32{binary.BigEndian.Uint32(ip), binary.BigEndian.Uint32(network.Mask)})
+		} else {
+			r.Nets6 = append(r.Nets6, network.String())
+		}
+	}
+	for _, port := range route.ports {
+		r.Ports = append(r.Ports, [2]int{port.From, port.To})
+	}
+	return r
+}
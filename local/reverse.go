@@ -0,0 +1,120 @@
+package local
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+)
+
+// 反向隧道断开或注册失败后重新注册的间隔
+const reverseRetryInterval = 5 * time.Second
+
+// ReverseTunnel 反向隧道，服务端remote_port上的入站连接经由到服务端的控制连接转发到本地的目的地址，类似ssh -R
+type ReverseTunnel struct {
+	// 在服务端开放的端口，需要服务端的用户策略允许
+	RemotePort int `json:"remote_port"`
+
+	// 本地的目的地址，例如127.0.0.1:3000
+	Target string `json:"target"`
+}
+
+// startReverseTunnels 每条反向隧道使用单独的控制连接，互不影响
+func (s *server) startReverseTunnels(ctx context.Context) {
+	for _, tunnel := range s.config.ReverseTunnels {
+		go s.keepReverseTunnel(ctx, tunnel)
+	}
+}
+
+// keepReverseTunnel 控制连接断开后按固定间隔重新注册，直到服务停止
+func (s *server) keepReverseTunnel(ctx context.Context, tunnel ReverseTunnel) {
+	for {
+		if err := s.serveReverseTunnel(ctx, tunnel); err != nil {
+			logrus.Errorf("Error occured in reverse tunnel %d -> %s: %s", tunnel.RemotePort, tunnel.Target, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reverseRetryInterval):
+		}
+	}
+}
+
+// serveReverseTunnel 完成认证后发送反向隧道请求，之后在控制连接上接受服务端打开的逻辑连接
+// 控制连接自身承载多路复用会话，服务端不接受嵌套在会话中的反向隧道请求，因此单独建立连接
+func (s *server) serveReverseTunnel(ctx context.Context, tunnel ReverseTunnel) error {
+	conn, u, err := s.openControl(ctx, strconv.Itoa(tunnel.RemotePort))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	bind, err := request(conn, proxy.ReverseCommand, &target{IP: net.IPv4zero, Port: tunnel.RemotePort})
+	if err != nil {
+		return errors.Wrapf(err, "Reverse request via %s failed", u.address)
+	}
+
+	session, err := proxy.NewMuxServer(conn, proxy.NewMuxConfig(s.config.GetMuxKeepAlive()))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	// 服务停止时关闭会话，服务端随之关闭开放的端口
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	logrus.Infof("Reverse tunnel registered on %s, port %d -> %s", u.address, bind.Port, tunnel.Target)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrapf(err, "Reverse tunnel via %s closed", u.address)
+		}
+
+		go s.handleReverseStream(ctx, stream, tunnel.Target)
+	}
+}
+
+func (s *server) handleReverseStream(ctx context.Context, stream net.Conn, address string) {
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	source, err := readTarget(stream)
+	if err != nil {
+		logrus.Errorf("Error occoured while read reverse stream header: %s", err.Error())
+		return
+	}
+
+	dialer := s.dialer(0)
+	conn, err := dialer.DialContext(ctx, socks5.Tcp, address)
+	if err != nil {
+		logrus.Errorf("Error occoured while connect to %s: %s", address, err.Error())
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	logrus.Infof("Reverse connection from %s to %s", source.Address(), address)
+	s.relay(stream, conn)
+}
@@ -0,0 +1,314 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+)
+
+const (
+	RouteDirect = "direct"
+	RouteProxy  = "proxy"
+	RouteReject = "reject"
+
+	// 网段文件的检查间隔
+	routesReloadInterval = 5 * time.Second
+
+	// 网段规则需要匹配域名解析后的IP时，解析的超时时间
+	routeResolveTimeout = 3 * time.Second
+)
+
+// Route 一条分流规则，各项条件之间为且的关系，同一项中的多个值之间为或的关系，未配置的条件视为匹配
+type Route struct {
+	// 匹配后的动作，可选direct（直连）、proxy（经服务端代理）、reject（拒绝）
+	Action string `json:"action"`
+
+	// 目的域名后缀，example.com匹配该域名及其子域名
+	Domains []string `json:"domains,omitempty"`
+
+	// 目的域名中包含的关键字
+	Keywords []string `json:"keywords,omitempty"`
+
+	// 目的地址所在的网段，以及网段文件（每行一个网段或IP，#之后为注释），目的地址为域名时解析后匹配
+	CIDRs     []string `json:"cidrs,omitempty"`
+	CIDRFiles []string `json:"cidr_files,omitempty"`
+
+	// 目的端口，支持单个端口以及8000-9000形式的端口范围
+	Ports []string `json:"ports,omitempty"`
+
+	suffixes []string
+	keywords []string
+	networks []*net.IPNet
+	ports    []socks5.PortRange
+}
+
+func (r *Route) compile() error {
+	switch r.Action {
+	case RouteDirect, RouteProxy, RouteReject:
+	default:
+		return errors.New(fmt.Sprintf("Unknown route action: %s", r.Action))
+	}
+
+	for _, domain := range r.Domains {
+		r.suffixes = append(r.suffixes, normalizeDomain(domain))
+	}
+	for _, keyword := range r.Keywords {
+		r.keywords = append(r.keywords, strings.ToLower(keyword))
+	}
+
+	networks, err := socks5.ParseCIDRs(r.CIDRs)
+	if err != nil {
+		return err
+	}
+	r.networks = networks
+	for _, filePath := range r.CIDRFiles {
+		networks, err := socks5.LoadCIDRs(filePath)
+		if err != nil {
+			return err
+		}
+		r.networks = append(r.networks, networks...)
+	}
+
+	for _, port := range r.Ports {
+		portRange, err := socks5.ParsePortRange(port)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, portRange)
+	}
+	return nil
+}
+
+func (r *Route) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, item := range r.ports {
+		if item.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName 未配置域名和网段条件时视为匹配，同时配置了域名和网段时，满足其中之一即可
+func (r *Route) matchName(dest *routeTarget) bool {
+	if len(r.suffixes) == 0 && len(r.keywords) == 0 && len(r.networks) == 0 {
+		return true
+	}
+	if len(dest.FQDN) == 0 {
+		return false
+	}
+
+	domain := normalizeDomain(dest.FQDN)
+	for _, suffix := range r.suffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range r.keywords {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) matchNetwork(ctx context.Context, dest *routeTarget) bool {
+	if len(r.networks) == 0 {
+		return false
+	}
+	for _, ip := range dest.ips(ctx) {
+		if socks5.ContainsIP(r.networks, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTarget 目的地址为域名时，只在需要匹配网段时解析一次
+type routeTarget struct {
+	*target
+	lookup   routeLookupFunc
+	resolved bool
+	addrs    []net.IP
+}
+
+func (t *routeTarget) ips(ctx context.Context) []net.IP {
+	if len(t.IP) != 0 {
+		return []net.IP{t.IP}
+	}
+	if t.resolved {
+		return t.addrs
+	}
+	t.resolved = true
+
+	resolveCtx, cancel := context.WithTimeout(ctx, routeResolveTimeout)
+	defer cancel()
+	addrs, err := t.lookup(resolveCtx, t.FQDN)
+	if err != nil {
+		logrus.Warnf("Error occured while resolve %s for routing: %s", t.FQDN, err.Error())
+		return nil
+	}
+	t.addrs = addrs
+	return t.addrs
+}
+
+// routeLookupFunc 解析目的域名的所有IP地址
+type routeLookupFunc func(ctx context.Context, name string) ([]net.IP, error)
+
+// routeLookup 默认经服务端解析，避免访问的域名泄露给本地的解析器，配置route_resolve_local时使用系统解析器
+func (s *server) routeLookup() routeLookupFunc {
+	if s.config.RouteResolveLocal {
+		return lookupSystem
+	}
+	return s.dns.lookup
+}
+
+func lookupSystem(ctx context.Context, name string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// router 按顺序匹配分流规则，以第一条匹配的规则为准，都不匹配时采用默认动作
+type router struct {
+	config *Config
+	lookup routeLookupFunc
+
+	lock          sync.RWMutex
+	routes        []*Route
+	defaultAction string
+}
+
+func newRouter(config *Config, lookup routeLookupFunc) (*router, error) {
+	r := &router{config: config, lookup: lookup}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload 重新编译规则并加载网段文件，任一规则有误时保留之前的规则
+func (r *router) reload() error {
+	routes, err := compileRoutes(r.config.Routes)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.routes, r.defaultAction = routes, r.config.GetDefaultRoute()
+	r.lock.Unlock()
+	return nil
+}
+
+// watch 网段文件发生变化时自动重新加载
+func (r *router) watch(ctx context.Context) {
+	watched := make(map[string]bool)
+	for _, route := range r.config.Routes {
+		for _, filePath := range route.CIDRFiles {
+			if watched[filePath] {
+				continue
+			}
+			watched[filePath] = true
+			filePath := filePath
+			go socks5.WatchFile(ctx, filePath, routesReloadInterval, func() {
+				if err := r.reload(); err != nil {
+					logrus.Errorf("Error occured while reload routes: %s", err.Error())
+					return
+				}
+				logrus.Infof("Routes reloaded from %s", filePath)
+			})
+		}
+	}
+}
+
+// route 返回目的地址对应的动作，目的域名只在可能影响结果时才解析
+func (r *router) route(ctx context.Context, dest *target) string {
+	r.lock.RLock()
+	routes, defaultAction := r.routes, r.defaultAction
+	r.lock.RUnlock()
+
+	routeDest := &routeTarget{target: dest, lookup: r.lookup}
+	for i, route := range routes {
+		if !route.matchPort(dest.Port) {
+			continue
+		}
+		if route.matchName(routeDest) {
+			return route.Action
+		}
+		if len(route.networks) == 0 {
+			continue
+		}
+		if len(dest.FQDN) != 0 && !routeDest.resolved && decided(route.Action, routes[i+1:], routeDest, defaultAction) {
+			return route.Action
+		}
+		if route.matchNetwork(ctx, routeDest) {
+			return route.Action
+		}
+	}
+	return defaultAction
+}
+
+// decided 当前规则不匹配时，后续可能生效的规则以及默认动作都与action相同，此时不必解析目的域名
+func decided(action string, routes []*Route, dest *routeTarget, defaultAction string) bool {
+	for _, route := range routes {
+		if !route.matchPort(dest.Port) {
+			continue
+		}
+		matched := route.matchName(dest)
+		if route.Action != action && (matched || len(route.networks) != 0) {
+			return false
+		}
+		if matched {
+			return true
+		}
+	}
+	return defaultAction == action
+}
+
+// pac 使用当前的规则生成PAC文件，address为socks5-local的代理地址
+func (r *router) pac(address string) ([]byte, error) {
+	r.lock.RLock()
+	routes, defaultAction := r.routes, r.defaultAction
+	r.lock.RUnlock()
+	return generatePAC(routes, defaultAction, address)
+}
+
+// compileRoutes 编译配置中的规则，不修改配置本身，以便重新加载
+func compileRoutes(routes []Route) ([]*Route, error) {
+	compiled := make([]*Route, 0, len(routes))
+	for i := range routes {
+		route := &Route{
+			Action:    routes[i].Action,
+			Domains:   routes[i].Domains,
+			Keywords:  routes[i].Keywords,
+			CIDRs:     routes[i].CIDRs,
+			CIDRFiles: routes[i].CIDRFiles,
+			Ports:     routes[i].Ports,
+		}
+		if err := route.compile(); err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, route)
+	}
+	return compiled, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
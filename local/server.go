@@ -1,11 +1,12 @@
 package local
 
 import (
+	"bufio"
 	"context"
-	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 
@@ -19,7 +20,10 @@ import (
 type server struct {
 	config   *Config
 	listener net.Listener
-	remote   *net.TCPAddr
+	cipher   *proxy.Cipher
+	balancer *balancer
+	router   *router
+	dns      *dnsForwarder
 }
 
 var singleton *server
@@ -45,19 +49,58 @@ func (s *server) StartServer() {
 		return
 	}
 
-	// 解析socks5服务端地址
-	remote, err := net.ResolveTCPAddr(socks5.Tcp, s.config.RemoteAddress)
+	// 配置了预共享密钥时，对发往服务端的数据加密
+	if err := s.initTransport(); err != nil {
+		logrus.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+
+	// 在一个或多个服务端之间负载均衡，TLS配置及多路复用会话按服务端分别维护
+	b, err := newBalancer(s)
+	if err != nil {
+		logrus.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+	s.balancer = b
+
+	// 本地DNS以及分流规则解析目的域名时使用，查询经服务端解析
+	s.dns = newDNSForwarder(s)
+
+	// 按照分流规则决定目的地址直连、经服务端代理或拒绝
+	r, err := newRouter(s.config, s.routeLookup())
 	if err != nil {
-		logrus.Errorf("Invalid remote address[%s]: %s", s.config.RemoteAddress, err.Error())
+		logrus.Errorf("Invalid configuration: %s", err.Error())
 		return
 	}
-	s.remote = remote
+	s.router = r
 
 	// 监听kill信号，用于graceful shutdown
 	channel := make(chan os.Signal, 1)
 	signal.Notify(channel, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 	go s.waitingSignal(channel, cancel)
+	s.router.watch(ctx)
+
+	// 定期检查服务端是否可用，不可用的服务端不参与负载均衡
+	if s.config.HealthCheckInterval >= 0 {
+		go s.balancer.healthCheck(ctx, s.config.GetHealthCheckInterval())
+	}
+
+	// 开启透明代理时，另外监听由iptables重定向的流量
+	if s.config.TransparentPort != 0 {
+		go s.listenTransparent(ctx)
+	}
+
+	// 开启本地DNS时，查询经服务端解析，避免DNS泄露
+	if s.config.DNSPort != 0 {
+		go s.listenDNS(ctx)
+	}
+
+	// 静态端口转发，每条转发单独监听
+	s.listenForwards(ctx)
+
+	// 注册反向隧道，断开后自动重新注册
+	s.startReverseTunnels(ctx)
 
 	// 开始监听被代理到本地端口的流量
 	s.listen(ctx)
@@ -73,7 +116,7 @@ func (s *server) waitingSignal(channel chan os.Signal, cancel context.CancelFunc
 
 func (s *server) listen(ctx context.Context) {
 	listenConfig := net.ListenConfig{}
-	listener, err := listenConfig.Listen(ctx, socks5.Tcp, fmt.Sprintf(":%v", s.config.Port))
+	listener, err := listenConfig.Listen(ctx, socks5.Tcp, net.JoinHostPort(s.config.GetListenAddress(), strconv.Itoa(s.config.Port)))
 	if err != nil {
 		logrus.Infof("Error occured: %s", err.Error())
 		return
@@ -84,6 +127,8 @@ func (s *server) listen(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			logrus.Infof("Stopping socks5 local service...")
+			s.balancer.close()
+			s.dns.close()
 			return
 		default:
 			conn, err := listener.Accept()
@@ -92,17 +137,35 @@ func (s *server) listen(ctx context.Context) {
 				continue
 			}
 
-			go s.handle(conn)
+			go s.handle(ctx, conn)
 		}
 	}
 }
 
-func (s *server) handle(localConn net.Conn) {
-	remoteConn, err := net.DialTCP(socks5.Tcp, nil, s.remote)
+// handle 根据第一个字节区分本地应用使用的协议，配置本地认证时socks5与HTTP CONNECT均需要认证
+func (s *server) handle(ctx context.Context, localConn net.Conn) {
+	defer func() {
+		_ = localConn.Close()
+	}()
+
+	reader := bufio.NewReader(localConn)
+	version, err := reader.Peek(1)
 	if err != nil {
-		logrus.Errorf("Error occured while dial remote addr[%s]: %s", s.config.RemoteAddress, err.Error())
+		logrus.Errorf("Error occoured while get version byte: %s", err.Error())
 		return
 	}
+	switch {
+	case version[0] == socks5Version:
+		s.handleSocks5(ctx, reader, localConn)
+	case version[0] >= 'A' && version[0] <= 'Z' && !s.config.DisableHTTP:
+		s.handleHTTP(ctx, reader, localConn)
+	default:
+		logrus.Errorf("Unsupported socks version, expect %v, get %v", socks5Version, version[0])
+	}
+}
+
+// relay 在本地连接与服务端连接之间双向转发数据，直到两个方向都结束
+func (s *server) relay(localConn net.Conn, remoteConn net.Conn) {
 	logrus.Infof("proxy chain %s -> %s -> %s -> %s",
 		localConn.RemoteAddr().String(), localConn.LocalAddr().String(), remoteConn.LocalAddr().String(), remoteConn.RemoteAddr().String())
 
@@ -117,7 +180,6 @@ func (s *server) handle(localConn net.Conn) {
 			return
 		}
 	}
-
 }
 
 func (s *server) StopServer() {
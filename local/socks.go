@@ -0,0 +1,404 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+)
+
+const (
+	socks5Version = uint8(5)
+
+	noAuth              = uint8(0)
+	userPassAuth        = uint8(2)
+	noAcceptableMethods = uint8(0xff)
+
+	authVersion = uint8(1)
+	authSuccess = uint8(0)
+
+	ipv4Address = uint8(1)
+	fqdnAddress = uint8(3)
+	ipv6Address = uint8(4)
+
+	connectCommand = uint8(1)
+)
+
+const (
+	succeeded uint8 = iota
+	generalSocksServerFailure
+	connectionNotAllowedByRuleset
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addressTypeNotSupported
+)
+
+var addressTypeNotSupportedError = errors.New("Address type not supported")
+
+// target 本地应用请求的目标地址，域名不在本地解析，交由服务端处理
+type target struct {
+	FQDN string
+	IP   net.IP
+	Port int
+}
+
+func (t *target) Host() string {
+	if t.FQDN != "" {
+		return t.FQDN
+	}
+	return t.IP.String()
+}
+
+func (t *target) Address() string {
+	return net.JoinHostPort(t.Host(), strconv.Itoa(t.Port))
+}
+
+// readTarget 读取ATYP | DST.ADDR | DST.PORT格式的地址，按字节精确读取
+func readTarget(reader io.Reader) (*target, error) {
+	t := &target{}
+	atyp := []byte{0}
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return nil, err
+	}
+	switch atyp[0] {
+	case ipv4Address:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, err
+		}
+		t.IP = net.IP(ip)
+	case ipv6Address:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, err
+		}
+		t.IP = net.IP(ip)
+	case fqdnAddress:
+		if _, err := io.ReadFull(reader, atyp); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, int(atyp[0]))
+		if _, err := io.ReadFull(reader, fqdn); err != nil {
+			return nil, err
+		}
+		t.FQDN = string(fqdn)
+	default:
+		return nil, addressTypeNotSupportedError
+	}
+
+	port := []byte{0, 0}
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, err
+	}
+	t.Port = (int(port[0]) << 8) | int(port[1])
+	return t, nil
+}
+
+// encodeTarget 将地址编码为ATYP | ADDR | PORT格式，t为nil时编码为0.0.0.0:0
+func encodeTarget(t *target) ([]byte, error) {
+	var msg []byte
+	switch {
+	case t == nil:
+		return []byte{ipv4Address, 0, 0, 0, 0, 0, 0}, nil
+	case t.FQDN != "":
+		if len(t.FQDN) > 255 {
+			return nil, errors.New(fmt.Sprintf("Domain name too long: %s", t.FQDN))
+		}
+		msg = append([]byte{fqdnAddress, byte(len(t.FQDN))}, t.FQDN...)
+	case t.IP.To4() != nil:
+		msg = append([]byte{ipv4Address}, t.IP.To4()...)
+	case t.IP.To16() != nil:
+		msg = append([]byte{ipv6Address}, t.IP.To16()...)
+	default:
+		return nil, errors.New(fmt.Sprintf("Failed to format address: %v", t))
+	}
+	return append(msg, byte(t.Port>>8), byte(t.Port&0xff)), nil
+}
+
+func sendReply(w io.Writer, resp uint8, bind *target) error {
+	addr, err := encodeTarget(bind)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append([]byte{socks5Version, resp, 0}, addr...))
+	return err
+}
+
+// handleSocks5 接受本地应用的socks5请求，未配置本地认证时不需要认证，再以配置的用户名和密码向服务端发起请求
+func (s *server) handleSocks5(ctx context.Context, reader *bufio.Reader, conn net.Conn) {
+	// VER | NMETHODS | METHODS
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		logrus.Errorf("Error occoured while get method number bytes: %s", err.Error())
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		logrus.Errorf("Error occoured while get method bytes: %s", err.Error())
+		return
+	}
+	// 配置本地认证时只接受USERNAME/PASSWORD方式
+	method := noAuth
+	if s.localAuthRequired() {
+		method = userPassAuth
+	}
+	acceptable := false
+	for _, offered := range methods {
+		if offered == method {
+			acceptable = true
+		}
+	}
+	if !acceptable {
+		logrus.Errorf("No acceptable authentication method from %s, offered: %v", conn.RemoteAddr().String(), methods)
+		_, _ = conn.Write([]byte{socks5Version, noAcceptableMethods})
+		return
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		logrus.Errorf("Error occoured while initial socks connection setup: %s", err.Error())
+		return
+	}
+	if method == userPassAuth {
+		if err := s.authenticateLocal(reader, conn); err != nil {
+			logrus.Errorf("Error occoured while authenticate %s: %s", conn.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+
+	request := []byte{0, 0, 0}
+	if _, err := io.ReadFull(reader, request); err != nil {
+		logrus.Errorf("Error occoured while get request bytes: %s", err.Error())
+		return
+	}
+	if request[0] != socks5Version {
+		logrus.Errorf("Unsupported socks5 version, expect %v, get %v", socks5Version, request[0])
+		return
+	}
+	command := request[1]
+	dest, err := readTarget(reader)
+	if err == addressTypeNotSupportedError {
+		_ = sendReply(conn, addressTypeNotSupported, nil)
+		return
+	} else if err != nil {
+		logrus.Errorf("Error occoured while process request: %s", err.Error())
+		return
+	}
+	logrus.Infof("Request command %v from %s to %s", command, conn.RemoteAddr().String(), dest.Address())
+
+	local := proxy.NewBufferedConn(conn, reader)
+	if command != connectCommand {
+		s.forwardRequest(ctx, local, command, dest)
+		return
+	}
+
+	remote, bind, err := s.dial(ctx, dest)
+	if err != nil {
+		logrus.Errorf("Error occoured while connect to %s: %s", dest.Address(), err.Error())
+		rep := generalSocksServerFailure
+		if replyErr, ok := errors.Cause(err).(*replyError); ok {
+			rep = replyErr.rep
+		}
+		_ = sendReply(conn, rep, nil)
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	if err := sendReply(conn, succeeded, bind); err != nil {
+		logrus.Errorf("Error occoured while reply to %s: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	s.relay(local, remote)
+}
+
+// forwardRequest BIND和UDP ASSOCIATE的回复及后续数据由服务端直接发给本地应用，本地只完成认证并转发原始请求
+// 这两种命令不支持直连，分流规则为reject时拒绝，否则总是经服务端代理
+func (s *server) forwardRequest(ctx context.Context, local net.Conn, command uint8, dest *target) {
+	if s.router.route(ctx, dest) == RouteReject {
+		logrus.Infof("Reject command %v to %s by route", command, dest.Address())
+		_ = sendReply(local, connectionNotAllowedByRuleset, nil)
+		return
+	}
+	remote, _, err := s.openSocks(ctx, dest.Host())
+	if err != nil {
+		logrus.Errorf("Error occoured while forward command %v to %s: %s", command, dest.Address(), err.Error())
+		_ = sendReply(local, generalSocksServerFailure, nil)
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+
+	addr, err := encodeTarget(dest)
+	if err != nil {
+		logrus.Errorf("Error occoured while forward command %v to %s: %s", command, dest.Address(), err.Error())
+		return
+	}
+	if _, err := remote.Write(append([]byte{socks5Version, command, 0}, addr...)); err != nil {
+		logrus.Errorf("Error occoured while forward command %v to %s: %s", command, dest.Address(), err.Error())
+		return
+	}
+	s.relay(local, remote)
+}
+
+// handleHTTP 接受本地应用的HTTP CONNECT请求以及PAC文件的下载请求，其他请求不支持
+func (s *server) handleHTTP(ctx context.Context, reader *bufio.Reader, conn net.Conn) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		logrus.Errorf("Error occoured while read http request: %s", err.Error())
+		return
+	}
+	if req.Method == http.MethodGet && req.URL.Path == s.config.GetPACPath() {
+		s.servePAC(req, conn)
+		return
+	}
+	if req.Method != http.MethodConnect {
+		_ = proxy.WriteHTTPStatus(conn, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if !s.authenticateHTTP(req) {
+		logrus.Errorf("Http authentication failed from %s", conn.RemoteAddr().String())
+		resp := &http.Response{
+			StatusCode: http.StatusProxyAuthRequired,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Connection":         []string{"close"},
+				"Proxy-Authenticate": []string{`Basic realm="` + socks5.LocalSideName + `"`},
+			},
+			Close: true,
+		}
+		_ = resp.Write(conn)
+		return
+	}
+	dest, err := parseTarget(req.Host)
+	if err != nil {
+		_ = proxy.WriteHTTPStatus(conn, http.StatusBadRequest, nil)
+		return
+	}
+	logrus.Infof("Request http connect from %s to %s", conn.RemoteAddr().String(), dest.Address())
+
+	remote, _, err := s.dial(ctx, dest)
+	if err != nil {
+		logrus.Errorf("Error occoured while connect to %s: %s", dest.Address(), err.Error())
+		status := http.StatusBadGateway
+		if replyErr, ok := errors.Cause(err).(*replyError); ok && replyErr.rep == connectionNotAllowedByRuleset {
+			status = http.StatusForbidden
+		}
+		_ = proxy.WriteHTTPStatus(conn, status, nil)
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		logrus.Errorf("Error occoured while reply to %s: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	s.relay(proxy.NewBufferedConn(conn, reader), remote)
+}
+
+// servePAC 根据当前的分流规则生成PAC文件，代理地址使用浏览器访问本地端口时的地址
+func (s *server) servePAC(req *http.Request, conn net.Conn) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = strings.Trim(req.Host, "[]")
+	}
+	if len(host) == 0 {
+		host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+
+	pac, err := s.router.pac(net.JoinHostPort(host, strconv.Itoa(s.config.Port)))
+	if err != nil {
+		logrus.Errorf("Error occoured while generate pac: %s", err.Error())
+		_ = proxy.WriteHTTPStatus(conn, http.StatusInternalServerError, nil)
+		return
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{pacContentType}, "Connection": []string{"close"}},
+		ContentLength: int64(len(pac)),
+		Body:          ioutil.NopCloser(bytes.NewReader(pac)),
+		Close:         true,
+	}
+	if err := resp.Write(conn); err != nil {
+		logrus.Errorf("Error occoured while reply to %s: %s", conn.RemoteAddr().String(), err.Error())
+	}
+}
+
+// dial 按照分流规则直连、经服务端代理或拒绝，返回连接及其绑定的地址
+// 拒绝时返回connectionNotAllowedByRuleset的replyError，与服务端按规则拒绝的处理一致
+func (s *server) dial(ctx context.Context, dest *target) (net.Conn, *target, error) {
+	action := s.router.route(ctx, dest)
+	logrus.Infof("Route %s to %s", dest.Address(), action)
+	switch action {
+	case RouteReject:
+		return nil, nil, errors.Wrapf(&replyError{rep: connectionNotAllowedByRuleset}, "Rejected by route")
+	case RouteDirect:
+		return s.dialDirect(ctx, dest)
+	default:
+		return s.connect(ctx, dest)
+	}
+}
+
+// dialDirect 不经过服务端，直接连接目标地址
+func (s *server) dialDirect(ctx context.Context, dest *target) (net.Conn, *target, error) {
+	dialer := s.dialer(dialTimeout)
+	conn, err := dialer.DialContext(ctx, socks5.Tcp, dest.Address())
+	if err != nil {
+		return nil, nil, err
+	}
+	bind := &target{}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bind.IP, bind.Port = addr.IP, addr.Port
+	}
+	return conn, bind, nil
+}
+
+// connect 通过服务端连接目标地址，sticky策略下相同目标总是使用同一服务端
+func (s *server) connect(ctx context.Context, dest *target) (net.Conn, *target, error) {
+	remote, u, err := s.openSocks(ctx, dest.Host())
+	if err != nil {
+		return nil, nil, err
+	}
+	bind, err := request(remote, connectCommand, dest)
+	if err != nil {
+		_ = remote.Close()
+		return nil, nil, errors.Wrapf(err, "Connect request via %s failed", u.address)
+	}
+	return remote, bind, nil
+}
+
+func parseTarget(hostport string) (*target, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New(fmt.Sprintf("Invalid port in address %s", hostport))
+	}
+	t := &target{Port: port}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		t.IP = ip
+	} else {
+		t.FQDN = host
+	}
+	return t, nil
+}
@@ -0,0 +1,107 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+)
+
+const (
+	// iptables REDIRECT，原始目的地址通过SO_ORIGINAL_DST获取
+	TransparentRedirect = "redirect"
+
+	// iptables TPROXY，连接的本地地址即为原始目的地址，需要CAP_NET_ADMIN权限
+	TransparentTProxy = "tproxy"
+)
+
+// listenTransparent 监听由iptables重定向的流量，按照原始目的地址经服务端代理或直连
+func (s *server) listenTransparent(ctx context.Context) {
+	mode := s.config.GetTransparentMode()
+	listenConfig := transparentListenConfig(mode)
+	listener, err := listenConfig.Listen(ctx, socks5.Tcp, fmt.Sprintf(":%v", s.config.TransparentPort))
+	if err != nil {
+		logrus.Errorf("Error occured while listen transparent port: %s", err.Error())
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	logrus.Infof("Transparent proxy listening on %s, mode: %s", listener.Addr().String(), mode)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			logrus.Errorf("Error occured while accept tcp: %s", err.Error())
+			continue
+		}
+
+		go s.handleTransparent(ctx, conn, mode)
+	}
+}
+
+func (s *server) handleTransparent(ctx context.Context, conn net.Conn, mode string) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	original, err := originalDst(tcpConn, mode)
+	if err != nil {
+		logrus.Errorf("Error occured while get original destination of %s: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	// 直接连接透明代理端口时，原始目的地址就是本机的该端口，继续连接会形成环路
+	if original.Port == s.config.TransparentPort && isLocalIP(original.IP) {
+		logrus.Errorf("Connection from %s is not redirected, original destination is the transparent port itself", conn.RemoteAddr().String())
+		return
+	}
+
+	dest := &target{IP: original.IP, Port: original.Port}
+	logrus.Infof("Transparent request from %s to %s", conn.RemoteAddr().String(), dest.Address())
+	remote, _, err := s.dial(ctx, dest)
+	if err != nil {
+		logrus.Errorf("Error occoured while connect to %s: %s", dest.Address(), err.Error())
+		return
+	}
+	defer func() {
+		_ = remote.Close()
+	}()
+	s.relay(conn, remote)
+}
+
+// isLocalIP 是否为本机的地址，包括回环地址以及各网卡上的地址
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialer 配置transparent_mark时为发出的连接设置SO_MARK，以便iptables跳过客户端自身的连接，避免被重定向回透明代理端口
+func (s *server) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: markControl(s.config.TransparentMark)}
+}
@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package local
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// linux/netfilter_ipv4.h及linux/netfilter_ipv6/ip6_tables.h中定义的选项
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// transparentListenConfig TPROXY模式需要在监听的socket上开启IP_TRANSPARENT
+func transparentListenConfig(mode string) net.ListenConfig {
+	if mode != TransparentTProxy {
+		return net.ListenConfig{}
+	}
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if sockErr == nil && network != "tcp4" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
+
+// markControl 为socket设置SO_MARK，需要CAP_NET_ADMIN权限，mark为0时不设置
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// originalDst 获取被重定向之前的目的地址，TPROXY模式下即为连接的本地地址
+func originalDst(conn *net.TCPConn, mode string) (*net.TCPAddr, error) {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if mode == TransparentTProxy {
+		return local, nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	// 双栈socket上的IPv4连接同样以SOL_IP获取，按本地地址的协议族决定先尝试哪一种
+	getters := []func(int) (*net.TCPAddr, error){originalDst4, originalDst6}
+	if local == nil || local.IP.To4() == nil {
+		getters[0], getters[1] = getters[1], getters[0]
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		for _, get := range getters {
+			if addr, sockErr = get(int(fd)); sockErr == nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// originalDst4 内核返回sockaddr_in，借用IPv6Mreq的16字节缓冲区读取
+func originalDst4(fd int) (*net.TCPAddr, error) {
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+	port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// originalDst6 内核返回sockaddr_in6，借用IPv6MTUInfo中的RawSockaddrInet6读取
+func originalDst6(fd int) (*net.TCPAddr, error) {
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, info.Addr.Addr[:])
+	// Port字段中保存的是网络字节序的原始内存
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
@@ -0,0 +1,216 @@
+//go:build linux
+// +build linux
+
+package local
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 在新的网络命名空间中重新执行测试，设置该环境变量的进程负责配置iptables并检查原始目的地址
+const transparentNetnsEnv = "SOCKS5_TRANSPARENT_NETNS"
+
+// run 执行ip、iptables等命令，在新的网络命名空间中没有成功时视为环境不支持
+func run(t *testing.T, name string, args ...string) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Skipf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, output)
+	}
+}
+
+// inNetns 在新的网络命名空间中执行当前测试，没有权限或缺少命令时跳过，返回false时调用方应直接返回
+func inNetns(t *testing.T) bool {
+	if os.Getenv(transparentNetnsEnv) == "1" {
+		return true
+	}
+	for _, name := range []string{"ip", "iptables", "ip6tables"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), transparentNetnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	output, err := cmd.CombinedOutput()
+	switch {
+	case err != nil && (os.IsPermission(err) || strings.Contains(err.Error(), "operation not permitted")):
+		t.Skipf("Network namespace is not permitted: %v", err)
+	case err != nil:
+		t.Fatalf("Test in network namespace failed: %v\n%s", err, output)
+	case strings.Contains(string(output), "--- SKIP"):
+		t.Skipf("Skipped in network namespace:\n%s", output)
+	}
+	t.Logf("%s", output)
+	return false
+}
+
+// acceptOriginalDst 连接address并返回监听端接受的连接上获取到的原始目的地址
+func acceptOriginalDst(t *testing.T, listener net.Listener, address string, mode string) *net.TCPAddr {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.DialTimeout("tcp", address, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Dial %s failed: %v", address, err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	conn, ok := <-accepted
+	if !ok {
+		t.Fatalf("Accept failed")
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	original, err := originalDst(conn.(*net.TCPConn), mode)
+	if err != nil {
+		t.Fatalf("Get original destination of %s failed: %v", address, err)
+	}
+	return original
+}
+
+func setupLoopback(t *testing.T) {
+	run(t, "ip", "link", "set", "lo", "up")
+	run(t, "ip", "addr", "add", "198.51.100.7/32", "dev", "lo")
+	run(t, "ip", "-6", "addr", "add", "2001:db8::7/128", "dev", "lo")
+}
+
+func TestOriginalDstRedirect(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	setupLoopback(t)
+
+	listenConfig := transparentListenConfig(TransparentRedirect)
+	listener, err := listenConfig.Listen(context.Background(), "tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	run(t, "iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "198.51.100.7", "--dport", "80", "-j", "REDIRECT", "--to-ports", port)
+	run(t, "ip6tables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "2001:db8::7", "--dport", "80", "-j", "REDIRECT", "--to-ports", port)
+
+	for _, address := range []string{"198.51.100.7:80", "[2001:db8::7]:80"} {
+		if original := acceptOriginalDst(t, listener, address, TransparentRedirect); original.String() != address {
+			t.Fatalf("Unexpected original destination %s, expect %s", original, address)
+		}
+	}
+}
+
+// 本机发出的流量在OUTPUT链打上标记，经策略路由回到lo后由PREROUTING链的TPROXY交给透明代理端口
+func TestOriginalDstTProxy(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	setupLoopback(t)
+
+	listenConfig := transparentListenConfig(TransparentTProxy)
+	listener, err := listenConfig.Listen(context.Background(), "tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	for _, family := range []struct {
+		flag     string
+		iptables string
+		network  string
+		any      string
+	}{
+		{flag: "-4", iptables: "iptables", network: "203.0.113.0/24", any: "0.0.0.0/0"},
+		{flag: "-6", iptables: "ip6tables", network: "2001:db8:1::/64", any: "::/0"},
+	} {
+		run(t, "ip", family.flag, "route", "add", family.network, "dev", "lo")
+		run(t, "ip", family.flag, "rule", "add", "fwmark", "1", "lookup", "100")
+		run(t, "ip", family.flag, "route", "add", "local", family.any, "dev", "lo", "table", "100")
+		run(t, family.iptables, "-t", "mangle", "-A", "OUTPUT", "-p", "tcp", "-d", family.network, "-j", "MARK", "--set-mark", "1")
+		run(t, family.iptables, "-t", "mangle", "-A", "PREROUTING", "-p", "tcp", "-d", family.network,
+			"-j", "TPROXY", "--on-port", port, "--tproxy-mark", "1")
+	}
+
+	for _, address := range []string{"203.0.113.9:80", "[2001:db8:1::9]:80"} {
+		if original := acceptOriginalDst(t, listener, address, TransparentTProxy); original.String() != address {
+			t.Fatalf("Unexpected original destination %s, expect %s", original, address)
+		}
+	}
+}
+
+func TestIsLocalIP(t *testing.T) {
+	for _, item := range []struct {
+		ip    string
+		local bool
+	}{
+		{ip: "127.0.0.1", local: true},
+		{ip: "::1", local: true},
+		{ip: "0.0.0.0", local: true},
+		{ip: "203.0.113.9", local: false},
+	} {
+		if local := isLocalIP(net.ParseIP(item.ip)); local != item.local {
+			t.Fatalf("isLocalIP(%s) = %v, expect %v", item.ip, local, item.local)
+		}
+	}
+}
+
+func TestDialerMark(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	s := &server{config: &Config{TransparentMark: 255}}
+	conn, err := s.dialer(time.Second).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skipf("SO_MARK requires CAP_NET_ADMIN: %v", err)
+		}
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var mark int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		mark, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	}); err != nil || sockErr != nil {
+		t.Fatalf("Get SO_MARK failed: %v %v", err, sockErr)
+	}
+	if mark != 255 {
+		t.Fatalf("Unexpected mark %d, expect 255", mark)
+	}
+}
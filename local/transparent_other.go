@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func transparentListenConfig(mode string) net.ListenConfig {
+	return net.ListenConfig{}
+}
+
+func originalDst(conn *net.TCPConn, mode string) (*net.TCPAddr, error) {
+	return nil, errors.New("Transparent proxy is only supported on linux")
+}
+
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("SO_MARK is only supported on linux")
+	}
+}
@@ -0,0 +1,197 @@
+package local
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+)
+
+const (
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+
+	defaultWebSocketPath = "/"
+
+	dialTimeout = 10 * time.Second
+)
+
+// initTransport 根据配置初始化预共享密钥加密，TLS配置与服务端地址相关，由每个upstream各自创建
+func (s *server) initTransport() error {
+	if len(s.config.Key) != 0 {
+		cipher, err := proxy.NewCipher(s.config.Cipher, s.config.Key)
+		if err != nil {
+			return err
+		}
+		s.cipher = cipher
+	}
+	return nil
+}
+
+// newTLSConfig 创建连接到address的TLS配置，两者同时配置时TLS在预共享密钥加密的外层
+func (s *server) newTLSConfig(address string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: s.config.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(tlsConfig.ServerName) == 0 {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+
+	// 未指定CA时使用系统的根证书
+	if len(s.config.TLSCA) != 0 {
+		pool, err := socks5.LoadCertPool(s.config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// 服务端要求双向认证时提供客户端证书
+	if len(s.config.TLSCert) != 0 {
+		cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// 只配置了公钥指纹而没有CA时，以指纹代替证书链的校验，适用于自签名证书
+	if len(s.config.TLSPins) != 0 {
+		pins := make(map[string]struct{}, len(s.config.TLSPins))
+		for _, pin := range s.config.TLSPins {
+			pins[pin] = struct{}{}
+		}
+		serverName := tlsConfig.ServerName
+		tlsConfig.InsecureSkipVerify = len(s.config.TLSCA) == 0
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(verifiedChains) != 0 {
+				return verifyChainPins(verifiedChains, pins)
+			}
+			return verifyPins(rawCerts, pins, serverName)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyChainPins 证书链已经由CA校验，链中任一证书的公钥指纹与配置一致即通过
+func verifyChainPins(verifiedChains [][]*x509.Certificate, pins map[string]struct{}) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if _, exist := pins[socks5.SPKIPin(cert)]; exist {
+				return nil
+			}
+		}
+	}
+	return errors.New("No certificate matches the configured pins")
+}
+
+// verifyPins 没有CA时服务端发送的证书链未经校验，叶子证书的指纹一致即通过；
+// 指纹为中间证书或根证书时，以该证书作为唯一的根证书校验叶子证书的签名链及服务器名称
+func verifyPins(rawCerts [][]byte, pins map[string]struct{}, serverName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("No certificate presented by remote")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if _, exist := pins[socks5.SPKIPin(certs[0])]; exist {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range certs[1:] {
+		if _, exist := pins[socks5.SPKIPin(cert)]; !exist {
+			continue
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.New("No certificate matches the configured pins")
+}
+
+// dialUpstream 开启多路复用时在已有会话上打开逻辑连接，否则建立新的连接
+func (s *server) dialUpstream(ctx context.Context, u *upstream) (net.Conn, error) {
+	if u.muxPool != nil {
+		return u.muxPool.open(ctx)
+	}
+	return s.dialRemote(ctx, u)
+}
+
+// dialRemote 建立到服务端的连接，并按照配置完成TLS握手及加密
+func (s *server) dialRemote(ctx context.Context, u *upstream) (net.Conn, error) {
+	dialer := s.dialer(dialTimeout)
+	conn, err := dialer.DialContext(ctx, socks5.Tcp, u.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.tlsConfig != nil {
+		tlsConn := tls.Client(conn, u.tlsConfig)
+		handshakeCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrapf(err, "Tls handshake with %s failed", u.address)
+		}
+		conn = tlsConn
+	}
+
+	// WebSocket隧道在TLS之内，预共享密钥加密之外
+	if s.config.Transport == TransportWS || s.config.Transport == TransportWSS {
+		host := s.config.TLSServerName
+		if len(host) == 0 {
+			host = u.address
+		}
+		wsConn, err := proxy.DialWebSocket(conn, host, s.config.GetWebSocketPath())
+		if err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrapf(err, "Websocket handshake with %s failed", u.address)
+		}
+		conn = wsConn
+	}
+
+	if s.cipher != nil {
+		conn = proxy.NewSecureConn(conn, s.cipher)
+	}
+	return conn, nil
+}
+
+func checkTransport(transport string) error {
+	switch transport {
+	case "", TransportTCP, TransportTLS, TransportWS, TransportWSS:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("Unsupported transport: %s", transport))
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	CipherAES128GCM        = "aes-128-gcm"
+	CipherAES256GCM        = "aes-256-gcm"
+	CipherChacha20Poly1305 = "chacha20-poly1305"
+
+	DefaultCipher = CipherChacha20Poly1305
+
+	// 由预共享密钥派生主密钥时使用的salt，以及由主密钥和salt派生每个方向的子密钥时使用的info
+	masterKeySalt = "socks5-master-key"
+	subkeyInfo    = "socks5-subkey"
+
+	// scrypt的参数，预共享密钥通常是人可以记住的口令，派生主密钥需要足够的计算量以抵抗离线猜测
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+type cipherSpec struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSpecs = map[string]cipherSpec{
+	CipherAES128GCM:        {keySize: 16, newAEAD: newGCM},
+	CipherAES256GCM:        {keySize: 32, newAEAD: newGCM},
+	CipherChacha20Poly1305: {keySize: chacha20poly1305.KeySize, newAEAD: chacha20poly1305.New},
+}
+
+// Cipher 保存预共享密钥派生出的主密钥，每个连接的每个方向使用随机salt派生独立的子密钥
+type Cipher struct {
+	spec      cipherSpec
+	masterKey []byte
+
+	// 为nil时不检查重放，服务端使用，记录见过的salt
+	filter *SaltFilter
+}
+
+// CheckCipher 校验算法名称和预共享密钥，不派生密钥
+func CheckCipher(name string, key string) error {
+	if len(name) == 0 {
+		name = DefaultCipher
+	}
+	if _, exist := cipherSpecs[name]; !exist {
+		return errors.New(fmt.Sprintf("Unsupported cipher: %s", name))
+	}
+	if len(key) == 0 {
+		return errors.New("Key should not be empty")
+	}
+	return nil
+}
+
+// NewCipher 根据算法名称和预共享密钥创建Cipher，算法为空时使用chacha20-poly1305，主密钥由scrypt派生
+func NewCipher(name string, key string) (*Cipher, error) {
+	if err := CheckCipher(name, key); err != nil {
+		return nil, err
+	}
+	if len(name) == 0 {
+		name = DefaultCipher
+	}
+	spec := cipherSpecs[name]
+
+	masterKey, err := scrypt.Key([]byte(key), []byte(masterKeySalt), scryptN, scryptR, scryptP, spec.keySize)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{spec: spec, masterKey: masterKey}, nil
+}
+
+// SetReplayFilter 开启重放检查，对端发送的salt与之前任一连接的salt相同时拒绝该连接
+func (c *Cipher) SetReplayFilter(filter *SaltFilter) {
+	c.filter = filter
+}
+
+func (c *Cipher) saltSize() int {
+	return c.spec.keySize
+}
+
+// newAEAD 使用salt派生子密钥，双方各自以自己发送的salt加密
+func (c *Cipher) newAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.spec.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.masterKey, salt, []byte(subkeyInfo)), subkey); err != nil {
+		return nil, err
+	}
+	return c.spec.newAEAD(subkey)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
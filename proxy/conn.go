@@ -1,21 +1,191 @@
 package proxy
 
-import "net"
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
 
+	"github.com/pkg/errors"
+)
+
+const (
+	// 单个数据块的最大长度，长度字段的最高两位保留
+	maxChunkPayload = 0x3fff
+	chunkLengthSize = 2
+)
+
+// BufferedConn 优先读取bufio.Reader中已缓冲的数据，用于在协议协商之后替换底层连接
+type BufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn, reader *bufio.Reader) *BufferedConn {
+	return &BufferedConn{Conn: conn, reader: reader}
+}
+
+func (c *BufferedConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *BufferedConn) CloseWrite() error {
+	if closer, ok := c.Conn.(closeWriter); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+// SecureConn 对连接上的数据进行AEAD加密，每个方向的数据格式为
+// SALT | LEN | LEN_TAG | PAYLOAD | PAYLOAD_TAG | LEN | LEN_TAG | PAYLOAD | PAYLOAD_TAG ...
+// 其中长度和数据分别加密，nonce从0开始逐次递增
 type SecureConn struct {
-	Conn net.Conn
+	net.Conn
+	Cipher *Cipher
+
+	readLock  sync.Mutex
+	reader    cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+	pending   []byte
+
+	writeLock  sync.Mutex
+	writer     cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
+}
+
+func NewSecureConn(conn net.Conn, c *Cipher) *SecureConn {
+	return &SecureConn{Conn: conn, Cipher: c}
 }
 
 func (c *SecureConn) Write(buf []byte) (n int, err error) {
-	// TODO
-	return c.Conn.Write(buf)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// 首次写入时生成salt，随第一个数据块一同发送
+	var salt []byte
+	if c.writer == nil {
+		salt = make([]byte, c.Cipher.saltSize())
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return 0, err
+		}
+		// 自己发送的salt同样记录，避免对端把本方发出的数据原样发回
+		if c.Cipher.filter != nil {
+			c.Cipher.filter.Add(salt)
+		}
+		c.writer, err = c.Cipher.newAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writeNonce = make([]byte, c.writer.NonceSize())
+		c.writeBuf = make([]byte, 0, len(salt)+chunkLengthSize+maxChunkPayload+2*c.writer.Overhead())
+	}
+
+	for n < len(buf) || salt != nil {
+		end := n + maxChunkPayload
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		frame := append(c.writeBuf[:0], salt...)
+		length := []byte{0, 0}
+		binary.BigEndian.PutUint16(length, uint16(end-n))
+		frame = c.writer.Seal(frame, c.writeNonce, length, nil)
+		increaseNonce(c.writeNonce)
+		frame = c.writer.Seal(frame, c.writeNonce, buf[n:end], nil)
+		increaseNonce(c.writeNonce)
+
+		if _, err := c.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		n = end
+		salt = nil
+	}
+	return n, nil
 }
 
 func (c *SecureConn) Read(buf []byte) (n int, err error) {
-	// TODO
-	return c.Conn.Read(buf)
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	// 首次读取时根据对端发送的salt派生子密钥
+	if c.reader == nil {
+		salt := make([]byte, c.Cipher.saltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		if c.Cipher.filter != nil && !c.Cipher.filter.Add(salt) {
+			return 0, errors.New("Repeated salt, possible replay attack")
+		}
+		c.reader, err = c.Cipher.newAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.readNonce = make([]byte, c.reader.NonceSize())
+		c.readBuf = make([]byte, maxChunkPayload+c.reader.Overhead())
+	}
+
+	for len(c.pending) == 0 {
+		if c.pending, err = c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readChunk 读取并解密一个数据块，在数据块边界遇到EOF时原样返回io.EOF
+func (c *SecureConn) readChunk() ([]byte, error) {
+	overhead := c.reader.Overhead()
+	sealed := c.readBuf[:chunkLengthSize+overhead]
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return nil, err
+	}
+	length, err := c.reader.Open(sealed[:0], c.readNonce, sealed, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt chunk length")
+	}
+	increaseNonce(c.readNonce)
+
+	size := int(binary.BigEndian.Uint16(length)) & maxChunkPayload
+	sealed = c.readBuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	payload, err := c.reader.Open(sealed[:0], c.readNonce, sealed, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt chunk payload")
+	}
+	increaseNonce(c.readNonce)
+	return payload, nil
+}
+
+func (c *SecureConn) CloseWrite() error {
+	if closer, ok := c.Conn.(closeWriter); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+func (c *SecureConn) Close() error {
+	return c.Conn.Close()
 }
 
-func (c *SecureConn) Close() {
-	_ = c.Conn.Close()
+// increaseNonce 以小端序将nonce加一
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
 }
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// bufferConn 从reader读取，写入的数据保存在written中，用于检查和篡改加密后的数据
+type bufferConn struct {
+	net.Conn
+	reader  io.Reader
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Read(buf []byte) (int, error) {
+	return c.reader.Read(buf)
+}
+
+func (c *bufferConn) Write(buf []byte) (int, error) {
+	return c.written.Write(buf)
+}
+
+// seal 以cipher加密payload，返回发送到连接上的原始数据
+func seal(t *testing.T, cipher *Cipher, payload []byte) []byte {
+	conn := &bufferConn{}
+	if _, err := NewSecureConn(conn, cipher).Write(payload); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	return conn.written.Bytes()
+}
+
+func open(cipher *Cipher, sealed []byte) ([]byte, error) {
+	return ioutil.ReadAll(NewSecureConn(&bufferConn{reader: bytes.NewReader(sealed)}, cipher))
+}
+
+func TestSecureConnRoundTrip(t *testing.T) {
+	for _, name := range []string{CipherAES128GCM, CipherAES256GCM, CipherChacha20Poly1305} {
+		cipher, err := NewCipher(name, "a-long-random-secret")
+		if err != nil {
+			t.Fatalf("NewCipher(%s) failed: %v", name, err)
+		}
+		// 跨越多个数据块
+		payload := make([]byte, 3*maxChunkPayload+123)
+		_, _ = rand.Read(payload)
+
+		sealed := seal(t, cipher, payload)
+		if bytes.Contains(sealed, payload[:64]) {
+			t.Fatalf("%s: payload is not encrypted", name)
+		}
+		got, err := open(cipher, sealed)
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%s: payload mismatch", name)
+		}
+	}
+}
+
+func TestSecureConnThroughPipe(t *testing.T) {
+	cipher, err := NewCipher("", "a-long-random-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	client, server := NewSecureConn(clientConn, cipher), NewSecureConn(serverConn, cipher)
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			return
+		}
+		_, _ = server.Write(append([]byte("echo:"), buf...))
+	}()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "echo:hello" {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+}
+
+func TestSecureConnTamper(t *testing.T) {
+	cipher, err := NewCipher(CipherAES256GCM, "a-long-random-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := seal(t, cipher, []byte("GET / HTTP/1.1\r\n\r\n"))
+	saltSize := cipher.saltSize()
+
+	// 分别篡改salt、长度以及数据部分
+	for _, offset := range []int{0, saltSize, saltSize + chunkLengthSize + 16, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[offset] ^= 0x01
+		if _, err := open(cipher, tampered); err == nil {
+			t.Fatalf("Tampered byte at %d was not detected", offset)
+		}
+	}
+
+	// 截断的数据不能被当作正常结束
+	if _, err := open(cipher, sealed[:len(sealed)-1]); err == nil {
+		t.Fatal("Truncated data was not detected")
+	}
+
+	// 不同的密钥无法解密
+	other, err := NewCipher(CipherAES256GCM, "another-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(other, sealed); err == nil {
+		t.Fatal("Data was decrypted with a different key")
+	}
+}
+
+func TestSecureConnReplay(t *testing.T) {
+	client, err := NewCipher("", "a-long-random-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewCipher("", "a-long-random-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetReplayFilter(NewSaltFilter(DefaultSaltFilterSize))
+
+	sealed := seal(t, client, []byte("request"))
+	if _, err := open(server, sealed); err != nil {
+		t.Fatalf("First connection was rejected: %v", err)
+	}
+	if _, err := open(server, sealed); err == nil {
+		t.Fatal("Replayed connection was accepted")
+	}
+
+	// 服务端自己发出的数据被原样发回时同样拒绝
+	reflected := seal(t, server, []byte("response"))
+	if _, err := open(server, reflected); err == nil {
+		t.Fatal("Reflected connection was accepted")
+	}
+}
+
+func TestSaltFilterBounded(t *testing.T) {
+	filter := NewSaltFilter(2)
+	for _, salt := range []string{"a", "b", "c", "d"} {
+		if !filter.Add([]byte(salt)) {
+			t.Fatalf("Salt %s was reported as repeated", salt)
+		}
+	}
+	if filter.Add([]byte("c")) || filter.Add([]byte("d")) {
+		t.Fatal("Recent salts were forgotten")
+	}
+	// 写满当前一代后，最早的一代被丢弃
+	if !filter.Add([]byte("e")) {
+		t.Fatal("Salt e was reported as repeated")
+	}
+	if len(filter.current)+len(filter.previous) > 4 {
+		t.Fatalf("Filter grew beyond its bound: %d", len(filter.current)+len(filter.previous))
+	}
+	if !filter.Add([]byte("a")) {
+		t.Fatal("Oldest salt should have been evicted")
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSLookupFunc 解析域名的所有IP地址以及可以缓存的时长，域名不存在时返回IsNotFound为true的net.DNSError
+type DNSLookupFunc func(ctx context.Context, name string) ([]net.IP, time.Duration, error)
+
+// DNSExchangeFunc 将原始查询报文转发给上游解析器并返回应答报文
+type DNSExchangeFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+// ReadDNSMessage 读取以两字节长度为前缀的DNS报文，与DNS over TCP的格式相同
+func ReadDNSMessage(reader io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteDNSMessage 写入以两字节长度为前缀的DNS报文
+func WriteDNSMessage(writer io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("DNS message too long")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := writer.Write(buf)
+	return err
+}
+
+// AnswerDNS 使用lookup解析查询报文中的A、AAAA记录并构造响应报文，其他类型的查询交给forward转发，
+// forward为nil时返回NOTIMP，lookup未提供TTL时，应答使用defaultTTL（秒）
+func AnswerDNS(ctx context.Context, query []byte, lookup DNSLookupFunc, forward DNSExchangeFunc, defaultTTL uint32) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	if header.OpCode != 0 {
+		response.RCode = dnsmessage.RCodeNotImplemented
+		return response.Pack()
+	}
+	if question.Class != dnsmessage.ClassINET ||
+		(question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA) {
+		if forward == nil {
+			response.RCode = dnsmessage.RCodeNotImplemented
+			return response.Pack()
+		}
+		answer, err := forward(ctx, query)
+		if err != nil {
+			response.RCode = dnsmessage.RCodeServerFailure
+			return response.Pack()
+		}
+		return answer, nil
+	}
+
+	// 同时解析两种地址再按类型过滤，只有域名不存在时才返回NXDOMAIN，没有该类型的地址时返回空的应答
+	ips, ttl, err := lookup(ctx, strings.TrimSuffix(question.Name.String(), "."))
+	if err != nil {
+		response.RCode = dnsmessage.RCodeServerFailure
+		if dnsErr, ok := errors.Cause(err).(*net.DNSError); ok && dnsErr.IsNotFound {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+		return response.Pack()
+	}
+	answerTTL := defaultTTL
+	if ttl > 0 {
+		answerTTL = uint32((ttl + time.Second - 1) / time.Second)
+	}
+	for _, ip := range ips {
+		resourceHeader := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: answerTTL}
+		ip4 := ip.To4()
+		switch {
+		case question.Type == dnsmessage.TypeA && ip4 != nil:
+			body := &dnsmessage.AResource{}
+			copy(body.A[:], ip4)
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: resourceHeader, Body: body})
+		case question.Type == dnsmessage.TypeAAAA && ip4 == nil && len(ip) == net.IPv6len:
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip)
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: resourceHeader, Body: body})
+		}
+	}
+	return response.Pack()
+}
+
+// NewDNSQuery 构造查询name的qtype记录的报文，要求递归解析
+func NewDNSQuery(name string, qtype dnsmessage.Type, id uint16) ([]byte, error) {
+	fqdn, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: fqdn, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	return msg.Pack()
+}
+
+// ParseDNSAnswer 返回应答中的A、AAAA地址、所有记录中最小的TTL（秒）以及应答的RCODE
+func ParseDNSAnswer(answer []byte) ([]net.IP, uint32, dnsmessage.RCode, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		return nil, 0, 0, err
+	}
+	var ips []net.IP
+	var minTTL uint32
+	for i, resource := range msg.Answers {
+		if i == 0 || resource.Header.TTL < minTTL {
+			minTTL = resource.Header.TTL
+		}
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(append([]byte{}, body.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(append([]byte{}, body.AAAA[:]...)))
+		}
+	}
+	return ips, minTTL, msg.RCode, nil
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WriteHTTPStatus 回复只有状态行和首部的响应，之后由调用方关闭连接
+func WriteHTTPStatus(w io.Writer, code int, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Connection", "close")
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	return resp.Write(w)
+}
+
+// ParseBasicAuth 解析Proxy-Authorization首部中的Basic认证信息
+func ParseBasicAuth(value string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	credentials := string(decoded)
+	index := strings.IndexByte(credentials, ':')
+	if index < 0 {
+		return "", "", false
+	}
+	return credentials[:index], credentials[index+1:], true
+}
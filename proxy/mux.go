@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// yamux帧头的第一个字节为协议版本0，服务端据此区分多路复用会话与socks、HTTP请求
+	MuxVersion = byte(0)
+
+	defaultMuxKeepAlive = 30 * time.Second
+)
+
+// NewMuxConfig 创建多路复用会话的配置，keepAlive为0时使用默认的心跳间隔
+func NewMuxConfig(keepAlive time.Duration) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = true
+	config.KeepAliveInterval = defaultMuxKeepAlive
+	if keepAlive > 0 {
+		config.KeepAliveInterval = keepAlive
+	}
+	config.LogOutput = ioutil.Discard
+	return config
+}
+
+// MuxStream 将yamux的Close作为半关闭，以便proxy.Proxy在一个方向结束时通知对端
+type MuxStream struct {
+	*yamux.Stream
+}
+
+func (s *MuxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// MuxSession 在一个连接上承载多条逻辑连接，带有流量控制以及心跳
+type MuxSession struct {
+	*yamux.Session
+}
+
+func NewMuxClient(conn io.ReadWriteCloser, config *yamux.Config) (*MuxSession, error) {
+	session, err := yamux.Client(conn, config)
+	if err != nil {
+		return nil, err
+	}
+	return &MuxSession{Session: session}, nil
+}
+
+func NewMuxServer(conn io.ReadWriteCloser, config *yamux.Config) (*MuxSession, error) {
+	session, err := yamux.Server(conn, config)
+	if err != nil {
+		return nil, err
+	}
+	return &MuxSession{Session: session}, nil
+}
+
+func (s *MuxSession) Open() (net.Conn, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &MuxStream{Stream: stream}, nil
+}
+
+func (s *MuxSession) Accept() (net.Conn, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &MuxStream{Stream: stream}, nil
+}
@@ -7,6 +7,14 @@ import (
 	"github.com/liruonian/socks5"
 )
 
+const (
+	// 扩展命令，socks5-local请求在服务端开放端口，入站连接经由同一连接转发回socks5-local
+	ReverseCommand = uint8(0x80)
+
+	// 扩展命令，之后连接上传输以两字节长度为前缀的DNS报文，由服务端的解析器解析
+	DNSCommand = uint8(0x81)
+)
+
 var pool sync.Pool
 var once sync.Once
 
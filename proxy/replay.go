@@ -0,0 +1,44 @@
+package proxy
+
+import "sync"
+
+// DefaultSaltFilterSize 每一代记录的salt数，两代合计约占用十几MB内存
+const DefaultSaltFilterSize = 100000
+
+// SaltFilter 记录最近见过的salt，用于拒绝重放的连接
+// 使用两代集合交替，当前一代写满后丢弃上一代，内存占用有上限，最近size到2*size个salt总能被识别
+type SaltFilter struct {
+	size int
+
+	lock     sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+func NewSaltFilter(size int) *SaltFilter {
+	return &SaltFilter{
+		size:     size,
+		current:  make(map[string]struct{}, size),
+		previous: make(map[string]struct{}),
+	}
+}
+
+// Add 记录salt，salt已经存在时返回false
+func (f *SaltFilter) Add(salt []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := string(salt)
+	if _, exist := f.current[key]; exist {
+		return false
+	}
+	if _, exist := f.previous[key]; exist {
+		return false
+	}
+	if len(f.current) >= f.size {
+		f.previous = f.current
+		f.current = make(map[string]struct{}, f.size)
+	}
+	f.current[key] = struct{}{}
+	return true
+}
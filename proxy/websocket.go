@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RFC 6455中用于计算Sec-WebSocket-Accept的GUID
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsFinBit  = 0x80
+	wsMaskBit = 0x80
+
+	// 控制帧的负载不能超过125字节
+	wsMaxControlPayload = 125
+)
+
+// WebSocketConn 将WebSocket的二进制帧封装为net.Conn，客户端发送的帧需要加掩码
+// 发送Close帧视为半关闭，收到对端的Close帧后Read返回io.EOF
+type WebSocketConn struct {
+	net.Conn
+	reader io.Reader
+	client bool
+
+	readLock  sync.Mutex
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	readEOF   bool
+
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+// IsWebSocketUpgrade 判断HTTP请求是否为WebSocket升级请求
+func IsWebSocketUpgrade(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// AcceptWebSocket 服务端完成升级握手，reader中已缓冲的数据属于升级之后的帧
+func AcceptWebSocket(conn net.Conn, reader *bufio.Reader, req *http.Request) (*WebSocketConn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 || req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("Invalid websocket handshake")
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		return nil, err
+	}
+	return &WebSocketConn{Conn: conn, reader: reader}, nil
+}
+
+// DialWebSocket 客户端在已经建立的连接上发起升级握手
+func DialWebSocket(conn net.Conn, host string, path string) (*WebSocketConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New(fmt.Sprintf("Websocket handshake failed: %s", resp.Status))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("Websocket handshake failed: invalid accept key")
+	}
+	return &WebSocketConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+func (c *WebSocketConn) Read(buf []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for c.remaining == 0 {
+		if c.readEOF {
+			return 0, io.EOF
+		}
+		if err := c.nextDataFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(buf)) > c.remaining {
+		buf = buf[:c.remaining]
+	}
+	n, err := c.reader.Read(buf)
+	c.unmask(buf[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextDataFrame 读取帧头直到遇到数据帧，期间处理控制帧
+func (c *WebSocketConn) nextDataFrame() error {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		c.masked = header[1]&wsMaskBit != 0
+
+		// RFC 6455 5.1，客户端发送的帧必须加掩码，服务端发送的帧不能加掩码
+		if c.masked == c.client {
+			return errors.New("Invalid websocket frame mask")
+		}
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, extended); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, extended); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(extended)
+		}
+		if c.masked {
+			if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+				return err
+			}
+		}
+		c.maskPos = 0
+
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.remaining = length
+			if length == 0 {
+				continue
+			}
+			return nil
+		case wsOpClose, wsOpPing, wsOpPong:
+			if length > wsMaxControlPayload || header[0]&wsFinBit == 0 {
+				return errors.New("Websocket control frame too large or fragmented")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.reader, payload); err != nil {
+				return err
+			}
+			c.unmask(payload)
+			if opcode == wsOpClose {
+				c.readEOF = true
+				return io.EOF
+			}
+			if opcode == wsOpPing {
+				if err := c.writeFrame(wsOpPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			return errors.New(fmt.Sprintf("Unsupported websocket opcode: %v", opcode))
+		}
+	}
+}
+
+func (c *WebSocketConn) unmask(payload []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *WebSocketConn) Write(buf []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, wsFinBit|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = wsMaskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(payload)))
+	}
+
+	// 客户端发送的每一帧都使用随机掩码
+	if c.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.Conn.Write(frame)
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+	return err
+}
+
+// CloseWrite 发送Close帧，此后仍然可以读取对端的数据，直到收到对端的Close帧
+func (c *WebSocketConn) CloseWrite() error {
+	err := c.writeFrame(wsOpClose, nil)
+	if err == net.ErrClosed {
+		return nil
+	}
+	return err
+}
+
+func (c *WebSocketConn) Close() error {
+	_ = c.CloseWrite()
+	return c.Conn.Close()
+}
+
+func webSocketAccept(key string) string {
+	digest := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// wsFrame 构造一个WebSocket帧，mask为true时使用固定的掩码
+func wsFrame(fin bool, opcode byte, payload []byte, mask bool) []byte {
+	var frame []byte
+	first := opcode
+	if fin {
+		first |= wsFinBit
+	}
+	frame = append(frame, first)
+
+	var maskBit byte
+	if mask {
+		maskBit = wsMaskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(payload)))
+	}
+	if !mask {
+		return append(frame, payload...)
+	}
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i&3])
+	}
+	return frame
+}
+
+// dialWebSocketPair 在net.Pipe上完成升级握手，返回客户端和服务端的连接
+func dialWebSocketPair(t *testing.T) (*WebSocketConn, *WebSocketConn) {
+	clientConn, serverConn := net.Pipe()
+
+	type result struct {
+		conn *WebSocketConn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		if !IsWebSocketUpgrade(req) || req.URL.Path != "/ws" || req.Host != "example.com" {
+			accepted <- result{err: io.ErrUnexpectedEOF}
+			return
+		}
+		conn, err := AcceptWebSocket(serverConn, reader, req)
+		accepted <- result{conn: conn, err: err}
+	}()
+
+	client, err := DialWebSocket(clientConn, "example.com", "/ws")
+	if err != nil {
+		t.Fatalf("DialWebSocket failed: %v", err)
+	}
+	server := <-accepted
+	if server.err != nil {
+		t.Fatalf("AcceptWebSocket failed: %v", server.err)
+	}
+	return client, server.conn
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	client, server := dialWebSocketPair(t)
+	// net.Pipe的写入在对端读取之前阻塞，直接关闭底层连接
+	defer func() {
+		_ = client.Conn.Close()
+		_ = server.Conn.Close()
+	}()
+
+	// 分别覆盖7位、16位和64位长度
+	for _, size := range []int{1, 125, 126, 0xffff, 0x10000 + 7} {
+		payload := make([]byte, size)
+		if _, err := rand.Read(payload); err != nil {
+			t.Fatalf("Generate payload failed: %v", err)
+		}
+		for _, pair := range []struct {
+			name   string
+			writer *WebSocketConn
+			reader *WebSocketConn
+		}{
+			{name: "client to server", writer: client, reader: server},
+			{name: "server to client", writer: server, reader: client},
+		} {
+			errCh := make(chan error, 1)
+			go func(writer *WebSocketConn) {
+				_, err := writer.Write(payload)
+				errCh <- err
+			}(pair.writer)
+
+			received := make([]byte, size)
+			if _, err := io.ReadFull(pair.reader, received); err != nil {
+				t.Fatalf("%s: read %d bytes failed: %v", pair.name, size, err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("%s: write %d bytes failed: %v", pair.name, size, err)
+			}
+			if !bytes.Equal(received, payload) {
+				t.Fatalf("%s: payload of %d bytes mismatched", pair.name, size)
+			}
+		}
+	}
+
+	// 客户端半关闭后，服务端读到EOF，仍然可以继续发送数据
+	go func() {
+		_ = client.CloseWrite()
+	}()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after close frame returned %v, expect EOF", err)
+	}
+	go func() {
+		_, _ = server.Write([]byte("bye"))
+	}()
+	received := make([]byte, 3)
+	if _, err := io.ReadFull(client, received); err != nil || string(received) != "bye" {
+		t.Fatalf("Read after half close returned %q %v", received, err)
+	}
+}
+
+func TestWebSocketFragmentsAndControlFrames(t *testing.T) {
+	var input []byte
+	input = append(input, wsFrame(false, wsOpBinary, []byte("hel"), true)...)
+	input = append(input, wsFrame(true, wsOpPing, []byte("ping"), true)...)
+	input = append(input, wsFrame(false, wsOpContinuation, []byte("lo "), true)...)
+	input = append(input, wsFrame(true, wsOpPong, []byte("pong"), true)...)
+	input = append(input, wsFrame(true, wsOpContinuation, nil, true)...)
+	input = append(input, wsFrame(true, wsOpText, []byte("world"), true)...)
+	input = append(input, wsFrame(true, wsOpClose, []byte{0x03, 0xe8}, true)...)
+	input = append(input, wsFrame(true, wsOpBinary, []byte("ignored"), true)...)
+
+	conn := &bufferConn{reader: bytes.NewReader(input)}
+	server := &WebSocketConn{Conn: conn, reader: conn}
+	data, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("Unexpected data %q, expect %q", data, "hello world")
+	}
+
+	// 服务端对ping回复不加掩码的pong
+	if expect := wsFrame(true, wsOpPong, []byte("ping"), false); !bytes.Equal(conn.written.Bytes(), expect) {
+		t.Fatalf("Unexpected pong frame %x, expect %x", conn.written.Bytes(), expect)
+	}
+}
+
+func TestWebSocketRejectsInvalidFrames(t *testing.T) {
+	for _, item := range []struct {
+		name   string
+		client bool
+		frame  []byte
+	}{
+		{name: "unmasked frame from client", frame: wsFrame(true, wsOpBinary, []byte("data"), false)},
+		{name: "masked frame from server", client: true, frame: wsFrame(true, wsOpBinary, []byte("data"), true)},
+		{name: "masked control frame from server", client: true, frame: wsFrame(true, wsOpPing, []byte("ping"), true)},
+		{name: "control frame too large", frame: wsFrame(true, wsOpPing, make([]byte, wsMaxControlPayload+1), true)},
+		{name: "fragmented control frame", frame: wsFrame(false, wsOpPing, []byte("ping"), true)},
+		{name: "unknown opcode", frame: wsFrame(true, 0x3, []byte("data"), true)},
+	} {
+		conn := &bufferConn{reader: bytes.NewReader(item.frame)}
+		ws := &WebSocketConn{Conn: conn, reader: conn, client: item.client}
+		if _, err := ws.Read(make([]byte, 16)); err == nil || err == io.EOF {
+			t.Fatalf("%s: Read returned %v, expect error", item.name, err)
+		}
+		if conn.written.Len() != 0 {
+			t.Fatalf("%s: unexpected reply %x", item.name, conn.written.Bytes())
+		}
+	}
+}
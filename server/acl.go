@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/liruonian/socks5/server/auth"
+	"github.com/liruonian/socks5/server/rule"
+)
+
+// lookupPolicy 返回认证身份适用的访问策略，没有配置对应策略时返回nil
+func (s *server) lookupPolicy(identity *auth.Identity) *rule.Policy {
+	if s.policySet == nil {
+		return nil
+	}
+	if identity == nil {
+		return s.policySet.Lookup("", nil)
+	}
+	return s.policySet.Lookup(identity.Username, identity.Groups)
+}
+
+// sourceAllowed 判断用户是否可以从该客户端地址登录
+func (s *server) sourceAllowed(policy *rule.Policy, client *AddrSpec) bool {
+	if policy == nil || client == nil {
+		return true
+	}
+	return policy.AllowSource(client.IP)
+}
+
+// allowed 按照全局访问规则以及用户策略判断是否允许访问目的地址，域名需要在解析之后校验，避免通过域名绕过网段规则
+func (s *server) allowed(policy *rule.Policy, command uint8, dest *AddrSpec) bool {
+	target := &rule.Target{
+		Command: command,
+		FQDN:    dest.FQDN,
+		IP:      dest.IP,
+		Port:    dest.Port,
+	}
+	if s.ruleSet != nil && !s.ruleSet.Allow(target) {
+		return false
+	}
+	return policy == nil || policy.Allow(target)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5/server/rule"
+)
+
+const (
+	// UDP报文的最大长度
+	udpBufferSize = 64 * 1024
+
+	// UDP请求头 RSV(2) | FRAG(1)，不包含地址部分
+	udpHeaderSize = 3
+
+	// 目的地址在最后一次发往该地址的报文之后的有效时间，超时后其回包不再转发给客户端
+	udpTargetTimeout = 2 * time.Minute
+
+	// 单个association同时记录的目的地址上限，超过时淘汰最久未使用的地址
+	udpMaxTargets = 1024
+)
+
+type udpAssociation struct {
+	server  *server
+	ctx     context.Context
+	udpConn *net.UDPConn
+
+	// 建立association的客户端地址，IP为空或端口为0时以收到的第一个报文为准
+	client *net.UDPAddr
+
+	// 发起association的用户适用的访问策略，每个报文的目的地址都需要校验
+	policy *rule.Policy
+
+	// 客户端最近发送过报文的目的地址及最后发送的时间，只有来自这些地址的报文才会回传给客户端
+	targets map[string]time.Time
+}
+
+// handleAssociateRequest UDP报文不经过预共享密钥加密，配置了密钥时拒绝该命令以免流量以明文经过公网
+// 客户端地址取自TCP连接的对端，经多路复用会话或WebSocket隧道到达时对端是隧道的另一端而不是发送UDP报文的应用，
+// 此时以DST.ADDR及DST.PORT为准，未指定时以收到的第一个报文的来源为准
+func (s *server) handleAssociateRequest(ctx context.Context, conn net.Conn, request *Request, policy *rule.Policy) error {
+	if s.cipher != nil {
+		if err := request.reply(conn, commandNotSupported, nil); err != nil {
+			return err
+		}
+		return errors.New("Udp associate is not supported when a key is configured")
+	}
+
+	// 在与TCP连接相同的网卡上分配UDP端口
+	var bindIP net.IP
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bindIP = local.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		if err := request.reply(conn, generalSocksServerFailure, nil); err != nil {
+			return err
+		}
+		return err
+	}
+	defer func() {
+		_ = udpConn.Close()
+	}()
+
+	// 只接受来自发起请求的客户端的报文，DST.PORT非0时端口也必须一致
+	client := &net.UDPAddr{IP: request.DestAddr.IP, Port: request.DestAddr.Port}
+	if request.RemoteAddr != nil && !fromTunnel(ctx) {
+		client.IP = request.RemoteAddr.IP
+	}
+	if client.IP != nil && client.IP.IsUnspecified() {
+		client.IP = nil
+	}
+	if client.IP == nil && !fromTunnel(ctx) {
+		if err := request.reply(conn, generalSocksServerFailure, nil); err != nil {
+			return err
+		}
+		return errors.New("Unable to determine udp client address")
+	}
+
+	bind := udpConn.LocalAddr().(*net.UDPAddr)
+	if err := request.reply(conn, succeeded, &AddrSpec{IP: bind.IP, Port: bind.Port}); err != nil {
+		return err
+	}
+	logrus.Infof("UDP association %s established for client %s", bind.String(), client.String())
+
+	// 控制连接关闭时，association随之结束
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(ioutil.Discard, request.reader)
+		_ = udpConn.Close()
+	}()
+
+	association := &udpAssociation{
+		server:  s,
+		ctx:     ctx,
+		udpConn: udpConn,
+		client:  client,
+		policy:  policy,
+		targets: make(map[string]time.Time),
+	}
+	err = association.relay()
+	_ = conn.Close()
+	wg.Wait()
+	return err
+}
+
+func (a *udpAssociation) relay() error {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case a.isClient(from):
+			if err := a.forward(buf[:n]); err != nil {
+				logrus.Errorf("Error occured while forward udp packet from %s: %s", from.String(), err.Error())
+			}
+		case a.isTarget(from):
+			if err := a.reply(from, buf[:n]); err != nil {
+				logrus.Errorf("Error occured while reply udp packet from %s: %s", from.String(), err.Error())
+			}
+		default:
+			logrus.Debugf("Drop udp packet from unknown address %s", from.String())
+		}
+	}
+}
+
+func (a *udpAssociation) isClient(from *net.UDPAddr) bool {
+	if a.client.IP == nil {
+		// 经隧道建立且未指定客户端地址时，第一个报文的来源即为客户端
+		if a.isTarget(from) {
+			return false
+		}
+		a.client.IP = from.IP
+	}
+	if !a.client.IP.Equal(from.IP) {
+		return false
+	}
+	if a.client.Port == 0 {
+		a.client.Port = from.Port
+	}
+	return a.client.Port == from.Port
+}
+
+func (a *udpAssociation) isTarget(from *net.UDPAddr) bool {
+	last, exist := a.targets[from.String()]
+	return exist && time.Since(last) < udpTargetTimeout
+}
+
+// addTarget 记录客户端发往的目的地址，达到上限时先清除超时的地址，仍然不足时淘汰最久未使用的地址
+func (a *udpAssociation) addTarget(target *net.UDPAddr) {
+	key := target.String()
+	if _, exist := a.targets[key]; !exist && len(a.targets) >= udpMaxTargets {
+		var oldest string
+		var oldestTime time.Time
+		for k, last := range a.targets {
+			if time.Since(last) >= udpTargetTimeout {
+				delete(a.targets, k)
+				continue
+			}
+			if oldest == "" || last.Before(oldestTime) {
+				oldest, oldestTime = k, last
+			}
+		}
+		if len(a.targets) >= udpMaxTargets {
+			delete(a.targets, oldest)
+		}
+	}
+	a.targets[key] = time.Now()
+}
+
+// forward 解析客户端报文头 RSV | FRAG | ATYP | DST.ADDR | DST.PORT | DATA，并将DATA发往目的地址
+func (a *udpAssociation) forward(packet []byte) error {
+	if len(packet) < udpHeaderSize {
+		return errors.New("Short udp packet")
+	}
+
+	// 不支持分片，按照RFC 1928的要求直接丢弃
+	if packet[2] != 0 {
+		return errors.New("Udp fragmentation not supported")
+	}
+
+	reader := bytes.NewReader(packet[udpHeaderSize:])
+	dest, err := readAddrSpec(reader)
+	if err != nil {
+		return err
+	}
+	if dest.FQDN != "" {
+		_, addr, err := a.server.resolve(a.ctx, dest.FQDN)
+		if err != nil {
+			return err
+		}
+		dest.IP = addr
+	}
+	if !a.server.allowed(a.policy, AssociateCommand, dest) {
+		return errors.Wrapf(notAllowedByRulesetError, "Udp packet to %s", dest.Address())
+	}
+
+	target := &net.UDPAddr{IP: dest.IP, Port: dest.Port}
+	a.addTarget(target)
+
+	data := packet[len(packet)-reader.Len():]
+	_, err = a.udpConn.WriteToUDP(data, target)
+	return err
+}
+
+// reply 为目的地址返回的报文加上UDP请求头后回传给客户端
+func (a *udpAssociation) reply(from *net.UDPAddr, data []byte) error {
+	addrBytes, err := encodeAddrSpec(&AddrSpec{IP: from.IP, Port: from.Port})
+	if err != nil {
+		return err
+	}
+
+	packet := make([]byte, 0, udpHeaderSize+len(addrBytes)+len(data))
+	packet = append(packet, 0, 0, 0)
+	packet = append(packet, addrBytes...)
+	packet = append(packet, data...)
+
+	_, err = a.udpConn.WriteToUDP(packet, a.client)
+	return err
+}
@@ -1,16 +1,60 @@
 package auth
 
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+)
+
 const (
 	NoAuthenticationMethod               = uint8(0)
 	UsernamePasswordAuthenticationMethod = uint8(2)
 )
 
+// 配置文件中使用的认证方式名称
+var methodNames = map[string]uint8{
+	"no_auth":           NoAuthenticationMethod,
+	"gssapi":            GSSAPIAuthenticationMethod,
+	"username_password": UsernamePasswordAuthenticationMethod,
+}
+
+// ParseMethod 解析认证方式名称，自行注册的认证方式可以直接使用方法编号
+func ParseMethod(name string) (uint8, bool) {
+	if method, exist := methodNames[name]; exist {
+		return method, true
+	}
+	method, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || method == 0xff {
+		return 0, false
+	}
+	return uint8(method), true
+}
+
+// Authenticator 对应socks5方法协商中的一种认证方式，服务端回复所选方法后，由Authenticator完成各自的子协商
 type Authenticator interface {
 	GetMethod() uint8
-	Authenticate(actual Authentication, expect Authentication) error
+	Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*Identity, error)
+}
+
+// Identity 认证通过后的身份，匿名访问时Username为空
+type Identity struct {
+	Method   uint8
+	Username string
+	Groups   []string
+
+	// 认证方式要求对后续数据进行封装时不为nil，例如GSSAPI的完整性和机密性保护
+	Encapsulator Encapsulator
+}
+
+// Encapsulator 将认证后的连接替换为经过封装的连接
+type Encapsulator interface {
+	Encapsulate(conn net.Conn) net.Conn
 }
 
-type Authentication struct {
-	Principle   string
-	Credentials string
+func (i *Identity) String() string {
+	if i == nil || len(i.Username) == 0 {
+		return "anonymous"
+	}
+	return i.Username
 }
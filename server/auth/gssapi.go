@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	GSSAPIAuthenticationMethod = uint8(1)
+
+	// RFC 1961中的消息类型
+	gssapiVersion         = uint8(1)
+	gssapiMessageAuth     = uint8(1)
+	gssapiMessageProtect  = uint8(2)
+	gssapiMessageEncap    = uint8(3)
+	gssapiMessageAbort    = uint8(0xff)
+	gssapiMaxTokenLength  = 0xffff
+	gssapiMaxPayloadChunk = 16 * 1024
+
+	// RFC 1961中的保护级别
+	GSSAPIProtectionIntegrity       = uint8(1)
+	GSSAPIProtectionConfidentiality = uint8(2)
+	GSSAPIProtectionSelective       = uint8(3)
+)
+
+// GSSAPIMechanism 为每个连接创建服务端安全上下文，便于接入不同的GSS-API实现
+type GSSAPIMechanism interface {
+	NewContext() GSSAPIContext
+}
+
+// GSSAPIContext 对应GSS-API中由gss_accept_sec_context建立的安全上下文
+type GSSAPIContext interface {
+	// Accept 处理客户端发来的上下文令牌，返回需要回复给客户端的令牌以及上下文是否已经建立
+	Accept(token []byte) (output []byte, established bool, err error)
+
+	// SourceName 上下文建立后，返回客户端的principal
+	SourceName() string
+
+	// Wrap 对应gss_wrap，confidential为true时对数据加密
+	Wrap(payload []byte, confidential bool) ([]byte, error)
+
+	// Unwrap 对应gss_unwrap，返回原始数据以及是否经过加密
+	Unwrap(token []byte) (payload []byte, confidential bool, err error)
+
+	// SupportsConfidentiality 是否支持机密性保护
+	SupportsConfidentiality() bool
+}
+
+// GSSAPIAuthenticator 实现RFC 1961中的GSS-API认证方式
+type GSSAPIAuthenticator struct {
+	Mechanism GSSAPIMechanism
+}
+
+func (a *GSSAPIAuthenticator) GetMethod() uint8 {
+	return GSSAPIAuthenticationMethod
+}
+
+func (a *GSSAPIAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*Identity, error) {
+	secContext := a.Mechanism.NewContext()
+
+	// 交换上下文令牌，直至安全上下文建立
+	for {
+		token, err := readGSSAPIMessage(reader, gssapiMessageAuth)
+		if err != nil {
+			return nil, err
+		}
+		output, established, err := secContext.Accept(token)
+		if err != nil {
+			_, _ = writer.Write([]byte{gssapiVersion, gssapiMessageAbort})
+			return nil, errors.Wrap(err, "GSSAPI context establishment failed")
+		}
+		if len(output) > 0 {
+			if err := writeGSSAPIMessage(writer, gssapiMessageAuth, output); err != nil {
+				return nil, err
+			}
+		}
+		if established {
+			break
+		}
+	}
+
+	// 协商保护级别，保护级别本身以不加密的方式封装
+	token, err := readGSSAPIMessage(reader, gssapiMessageProtect)
+	if err != nil {
+		return nil, err
+	}
+	level, _, err := secContext.Unwrap(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unwrap protection level")
+	}
+	if len(level) != 1 {
+		return nil, errors.New("Invalid protection level message")
+	}
+	// 客户端要求加密或逐条选择保护方式时，统一使用加密，上下文不支持加密时退回到完整性校验
+	protection := level[0]
+	switch protection {
+	case GSSAPIProtectionIntegrity:
+	case GSSAPIProtectionConfidentiality, GSSAPIProtectionSelective:
+		protection = GSSAPIProtectionIntegrity
+		if secContext.SupportsConfidentiality() {
+			protection = GSSAPIProtectionConfidentiality
+		}
+	default:
+		_, _ = writer.Write([]byte{gssapiVersion, gssapiMessageAbort})
+		return nil, errors.New(fmt.Sprintf("Unsupported protection level: %v", level[0]))
+	}
+	token, err = secContext.Wrap([]byte{protection}, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeGSSAPIMessage(writer, gssapiMessageProtect, token); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Method:   GSSAPIAuthenticationMethod,
+		Username: secContext.SourceName(),
+		Encapsulator: &gssapiEncapsulator{
+			secContext:   secContext,
+			confidential: protection == GSSAPIProtectionConfidentiality,
+		},
+	}, nil
+}
+
+// readGSSAPIMessage 读取 VER | MTYP | LEN | TOKEN 格式的消息
+func readGSSAPIMessage(reader io.Reader, expectType uint8) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != gssapiVersion {
+		return nil, errors.New(fmt.Sprintf("Unsupported gssapi version, expect %v, get %v", gssapiVersion, header[0]))
+	}
+	if header[1] == gssapiMessageAbort {
+		return nil, errors.New("GSSAPI negotiation aborted by client")
+	}
+	if header[1] != expectType {
+		return nil, errors.New(fmt.Sprintf("Unexpected gssapi message type, expect %v, get %v", expectType, header[1]))
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(reader, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func writeGSSAPIMessage(writer io.Writer, messageType uint8, token []byte) error {
+	if len(token) > gssapiMaxTokenLength {
+		return errors.New(fmt.Sprintf("GSSAPI token too large: %v", len(token)))
+	}
+	msg := make([]byte, 4+len(token))
+	msg[0] = gssapiVersion
+	msg[1] = messageType
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	copy(msg[4:], token)
+	_, err := writer.Write(msg)
+	return err
+}
+
+type gssapiEncapsulator struct {
+	secContext   GSSAPIContext
+	confidential bool
+}
+
+func (e *gssapiEncapsulator) Encapsulate(conn net.Conn) net.Conn {
+	return &gssapiConn{Conn: conn, secContext: e.secContext, confidential: e.confidential}
+}
+
+// gssapiConn 按照协商的保护级别，对认证之后的所有数据进行封装
+type gssapiConn struct {
+	net.Conn
+	secContext   GSSAPIContext
+	confidential bool
+
+	readLock  sync.Mutex
+	pending   []byte
+	writeLock sync.Mutex
+}
+
+func (c *gssapiConn) Read(buf []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for len(c.pending) == 0 {
+		token, err := readGSSAPIMessage(c.Conn, gssapiMessageEncap)
+		if err != nil {
+			return 0, err
+		}
+		payload, confidential, err := c.secContext.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+		if c.confidential && !confidential {
+			return 0, errors.New("Unencrypted message received while confidentiality is required")
+		}
+		c.pending = payload
+	}
+
+	n := copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *gssapiConn) Write(buf []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	written := 0
+	for written < len(buf) {
+		end := written + gssapiMaxPayloadChunk
+		if end > len(buf) {
+			end = len(buf)
+		}
+		token, err := c.secContext.Wrap(buf[written:end], c.confidential)
+		if err != nil {
+			return written, err
+		}
+		if err := writeGSSAPIMessage(c.Conn, gssapiMessageEncap, token); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (c *gssapiConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"math"
+	"math/big"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RFC 4121中Wrap令牌的标志位
+	wrapFlagSentByAcceptor = byte(0x01)
+	wrapFlagSealed         = byte(0x02)
+
+	wrapTokenHeaderLength = 16
+)
+
+// KerberosMechanism 基于keytab校验客户端的Kerberos票据，实现RFC 4121中的GSS-API Kerberos机制
+type KerberosMechanism struct {
+	settings *service.Settings
+}
+
+// NewKerberosMechanism servicePrincipal为空时，使用票据中的服务名称在keytab中查找密钥
+func NewKerberosMechanism(keytabPath string, servicePrincipal string) (*KerberosMechanism, error) {
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while load keytab[%s]", keytabPath)
+	}
+
+	options := []func(*service.Settings){service.DecodePAC(false)}
+	if len(servicePrincipal) != 0 {
+		options = append(options, service.KeytabPrincipal(servicePrincipal))
+	}
+	return &KerberosMechanism{settings: service.NewSettings(kt, options...)}, nil
+}
+
+func (m *KerberosMechanism) NewContext() GSSAPIContext {
+	return &kerberosContext{settings: m.settings}
+}
+
+type kerberosContext struct {
+	settings  *service.Settings
+	principal string
+
+	// 客户端提供子密钥时使用子密钥，否则使用票据中的会话密钥
+	key     types.EncryptionKey
+	sendSeq uint64
+	recvSeq uint64
+}
+
+func (c *kerberosContext) Accept(token []byte) ([]byte, bool, error) {
+	var mechToken spnego.KRB5Token
+	if err := mechToken.Unmarshal(token); err != nil {
+		return nil, false, err
+	}
+	if !mechToken.IsAPReq() {
+		return nil, false, errors.New("Expect KRB_AP_REQ in context token")
+	}
+
+	apReq := mechToken.APReq
+	ok, creds, err := service.VerifyAPREQ(&apReq, c.settings)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, errors.New("Invalid KRB_AP_REQ")
+	}
+	c.principal = creds.CName().PrincipalNameString() + "@" + creds.Realm()
+
+	sessionKey := apReq.Ticket.DecryptedEncPart.Key
+	c.key = sessionKey
+	if apReq.Authenticator.SubKey.KeyType != 0 {
+		c.key = apReq.Authenticator.SubKey
+	}
+	c.recvSeq = uint64(apReq.Authenticator.SeqNumber)
+	c.sendSeq = c.recvSeq
+
+	// 客户端要求双向认证时，回复AP_REP
+	if !c.mutualRequested(&apReq) {
+		return nil, true, nil
+	}
+	seq, err := rand.Int(rand.Reader, big.NewInt(math.MaxUint32))
+	if err != nil {
+		return nil, false, err
+	}
+	c.sendSeq = seq.Uint64() & 0x3fffffff
+	output, err := newAPRepToken(&apReq, sessionKey, int64(c.sendSeq))
+	if err != nil {
+		return nil, false, err
+	}
+	return output, true, nil
+}
+
+func (c *kerberosContext) mutualRequested(apReq *messages.APReq) bool {
+	if types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired) {
+		return true
+	}
+
+	// GSS-API的上下文标志保存在认证器校验和中，参考RFC 4121 4.1.1
+	checksum := apReq.Authenticator.Cksum
+	if checksum.CksumType != chksumtype.GSSAPI || len(checksum.Checksum) < 24 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(checksum.Checksum[20:24])&gssapi.ContextFlagMutual != 0
+}
+
+func newAPRepToken(apReq *messages.APReq, sessionKey types.EncryptionKey, seq int64) ([]byte, error) {
+	part := messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		SequenceNumber: seq,
+	}
+	partBytes, err := asn1.Marshal(part)
+	if err != nil {
+		return nil, err
+	}
+	partBytes = asn1tools.AddASNAppTag(partBytes, asnAppTag.EncAPRepPart)
+	encPart, err := crypto.GetEncryptedData(partBytes, sessionKey, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	apRep := messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: encPart,
+	}
+	repBytes, err := asn1.Marshal(apRep)
+	if err != nil {
+		return nil, err
+	}
+	repBytes = asn1tools.AddASNAppTag(repBytes, asnAppTag.APREP)
+
+	// InitialContextToken格式：OID | TOK_ID | KRB_AP_REP
+	output, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	output = append(output, 0x02, 0x00)
+	output = append(output, repBytes...)
+	return asn1tools.AddASNAppTag(output, 0), nil
+}
+
+func (c *kerberosContext) SourceName() string {
+	return c.principal
+}
+
+func (c *kerberosContext) SupportsConfidentiality() bool {
+	return true
+}
+
+func (c *kerberosContext) Wrap(payload []byte, confidential bool) ([]byte, error) {
+	seq := c.sendSeq
+	c.sendSeq++
+
+	if !confidential {
+		encType, err := crypto.GetEtype(c.key.KeyType)
+		if err != nil {
+			return nil, err
+		}
+		token := gssapi.WrapToken{
+			Flags:     wrapFlagSentByAcceptor,
+			EC:        uint16(encType.GetHMACBitLength() / 8),
+			SndSeqNum: seq,
+			Payload:   payload,
+		}
+		if err := token.SetCheckSum(c.key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+			return nil, err
+		}
+		return token.Marshal()
+	}
+
+	// 加密数据为 payload | header，其中EC和RRC均为0
+	header := newWrapTokenHeader(wrapFlagSentByAcceptor|wrapFlagSealed, seq)
+	plain := make([]byte, 0, len(payload)+len(header))
+	plain = append(plain, payload...)
+	plain = append(plain, header...)
+	encrypted, err := crypto.GetEncryptedData(plain, c.key, keyusage.GSSAPI_ACCEPTOR_SEAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, encrypted.Cipher...), nil
+}
+
+func (c *kerberosContext) Unwrap(token []byte) ([]byte, bool, error) {
+	if len(token) < wrapTokenHeaderLength || token[0] != 0x05 || token[1] != 0x04 || token[3] != 0xff {
+		return nil, false, errors.New("Invalid wrap token")
+	}
+	tokenFlags := token[2]
+	if tokenFlags&wrapFlagSentByAcceptor != 0 {
+		return nil, false, errors.New("Unexpected wrap token sent by acceptor")
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:6]))
+	rrc := int(binary.BigEndian.Uint16(token[6:8]))
+	seq := binary.BigEndian.Uint64(token[8:16])
+	if seq != c.recvSeq {
+		return nil, false, errors.New("Unexpected sequence number of wrap token")
+	}
+	c.recvSeq++
+
+	// 撤销发送方对数据的右旋
+	data := token[wrapTokenHeaderLength:]
+	if len(data) > 0 && rrc%len(data) != 0 {
+		shift := rrc % len(data)
+		data = append(append([]byte{}, data[shift:]...), data[:shift]...)
+	}
+
+	if tokenFlags&wrapFlagSealed == 0 {
+		if len(data) < ec {
+			return nil, false, errors.New("Invalid wrap token checksum length")
+		}
+		wrapToken := gssapi.WrapToken{
+			Flags:     tokenFlags,
+			EC:        uint16(ec),
+			SndSeqNum: seq,
+			Payload:   data[:len(data)-ec],
+			CheckSum:  data[len(data)-ec:],
+		}
+		if ok, err := wrapToken.Verify(c.key, keyusage.GSSAPI_INITIATOR_SEAL); !ok {
+			return nil, false, err
+		}
+		return wrapToken.Payload, false, nil
+	}
+
+	plain, err := crypto.DecryptMessage(data, c.key, keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(plain) < ec+wrapTokenHeaderLength {
+		return nil, false, errors.New("Invalid sealed wrap token")
+	}
+
+	// 解密后的末尾为header的副本，除RRC外应与明文header一致
+	trailer := plain[len(plain)-wrapTokenHeaderLength:]
+	if subtle.ConstantTimeCompare(trailer[0:6], token[0:6]) != 1 || subtle.ConstantTimeCompare(trailer[8:], token[8:16]) != 1 {
+		return nil, false, errors.New("Wrap token header mismatch")
+	}
+	return plain[:len(plain)-wrapTokenHeaderLength-ec], true, nil
+}
+
+func newWrapTokenHeader(tokenFlags byte, seq uint64) []byte {
+	header := make([]byte, wrapTokenHeaderLength)
+	header[0] = 0x05
+	header[1] = 0x04
+	header[2] = tokenFlags
+	header[3] = 0xff
+	binary.BigEndian.PutUint64(header[8:], seq)
+	return header
+}
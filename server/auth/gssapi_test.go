@@ -0,0 +1,466 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testRealm            = "EXAMPLE.COM"
+	testServicePrincipal = "socks/proxy.example.com"
+	testClientPrincipal  = "alice"
+)
+
+// testKDC 代替KDC签发服务票据，服务端的密钥写入keytab文件
+type testKDC struct {
+	keytab     *keytab.Keytab
+	keytabPath string
+}
+
+func newTestKDC(t *testing.T, password string) *testKDC {
+	kt := keytab.New()
+	if err := kt.AddEntry(testServicePrincipal, testRealm, password, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatalf("AddEntry failed: %v", err)
+	}
+	data, err := kt.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal keytab failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "socks5.keytab")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Write keytab failed: %v", err)
+	}
+	return &testKDC{keytab: kt, keytabPath: path}
+}
+
+func (k *testKDC) ticket(t *testing.T) (messages.Ticket, types.EncryptionKey) {
+	now := time.Now().UTC()
+	ticket, sessionKey, err := messages.NewTicket(
+		types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, testClientPrincipal), testRealm,
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testServicePrincipal), testRealm,
+		types.NewKrbFlags(), k.keytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1,
+		now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewTicket failed: %v", err)
+	}
+	return ticket, sessionKey
+}
+
+// gssapiClient RFC 1961中客户端一侧的实现，安全上下文使用认证器中的子密钥
+type gssapiClient struct {
+	conn    net.Conn
+	key     types.EncryptionKey
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// establish 发送AP_REQ，mutual为true时校验服务端回复的AP_REP并使用其中的序列号
+func (c *gssapiClient) establish(t *testing.T, ticket messages.Ticket, sessionKey types.EncryptionKey, mutual bool) {
+	token, authenticator := c.initialToken(t, ticket, sessionKey, mutual)
+	c.send(t, gssapiMessageAuth, token)
+	if !mutual {
+		return
+	}
+
+	var repToken spnego.KRB5Token
+	if err := repToken.Unmarshal(c.receive(t, gssapiMessageAuth)); err != nil {
+		t.Fatalf("Unmarshal AP_REP failed: %v", err)
+	}
+	if !repToken.IsAPRep() {
+		t.Fatalf("Expect AP_REP from server")
+	}
+	plain, err := crypto.DecryptEncPart(repToken.APRep.EncPart, sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		t.Fatalf("Decrypt AP_REP failed: %v", err)
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(plain); err != nil {
+		t.Fatalf("Unmarshal EncAPRepPart failed: %v", err)
+	}
+	if part.CTime.Unix() != authenticator.CTime.Unix() || part.Cusec != authenticator.Cusec {
+		t.Fatalf("AP_REP does not match the authenticator")
+	}
+	c.recvSeq = uint64(part.SequenceNumber)
+}
+
+// initialToken 构造包含AP_REQ的上下文令牌，GSS-API的上下文标志保存在认证器校验和中
+func (c *gssapiClient) initialToken(t *testing.T, ticket messages.Ticket, sessionKey types.EncryptionKey, mutual bool) ([]byte, types.Authenticator) {
+	authenticator, err := types.NewAuthenticator(testRealm, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, testClientPrincipal))
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %v", err)
+	}
+	if err := authenticator.GenerateSeqNumberAndSubKey(sessionKey.KeyType, len(sessionKey.KeyValue)); err != nil {
+		t.Fatalf("GenerateSeqNumberAndSubKey failed: %v", err)
+	}
+	contextFlags := uint32(gssapi.ContextFlagInteg | gssapi.ContextFlagConf)
+	if mutual {
+		contextFlags |= gssapi.ContextFlagMutual
+	}
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	binary.LittleEndian.PutUint32(checksum[20:], contextFlags)
+	authenticator.Cksum = types.Checksum{CksumType: chksumtype.GSSAPI, Checksum: checksum}
+
+	apReq, err := messages.NewAPReq(ticket, sessionKey, authenticator)
+	if err != nil {
+		t.Fatalf("NewAPReq failed: %v", err)
+	}
+	reqBytes, err := apReq.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal AP_REQ failed: %v", err)
+	}
+	c.key = authenticator.SubKey
+	c.sendSeq = uint64(authenticator.SeqNumber)
+	c.recvSeq = c.sendSeq
+
+	token, err := marshalInitialContextToken(reqBytes)
+	if err != nil {
+		t.Fatalf("Marshal context token failed: %v", err)
+	}
+	return token, authenticator
+}
+
+// negotiate 请求保护级别，返回服务端选择的级别
+func (c *gssapiClient) negotiate(t *testing.T, level uint8) uint8 {
+	c.send(t, gssapiMessageProtect, c.wrap(t, []byte{level}, false, 0))
+	selected, confidential := c.unwrap(t, c.receive(t, gssapiMessageProtect))
+	if confidential || len(selected) != 1 {
+		t.Fatalf("Invalid protection level reply")
+	}
+	return selected[0]
+}
+
+// wrap 对应客户端的gss_wrap，rrc不为0时按照RFC 4121对数据右旋
+func (c *gssapiClient) wrap(t *testing.T, payload []byte, confidential bool, rrc int) []byte {
+	seq := c.sendSeq
+	c.sendSeq++
+
+	if !confidential {
+		encType, err := crypto.GetEtype(c.key.KeyType)
+		if err != nil {
+			t.Fatalf("GetEtype failed: %v", err)
+		}
+		token := gssapi.WrapToken{EC: uint16(encType.GetHMACBitLength() / 8), SndSeqNum: seq, Payload: payload}
+		if err := token.SetCheckSum(c.key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+			t.Fatalf("SetCheckSum failed: %v", err)
+		}
+		data, err := token.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal wrap token failed: %v", err)
+		}
+		return data
+	}
+
+	header := newWrapTokenHeader(wrapFlagSealed, seq)
+	encrypted, err := crypto.GetEncryptedData(append(append([]byte{}, payload...), header...), c.key, keyusage.GSSAPI_INITIATOR_SEAL, 0)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	data := encrypted.Cipher
+	if rrc > 0 {
+		binary.BigEndian.PutUint16(header[6:8], uint16(rrc))
+		shift := rrc % len(data)
+		data = append(append([]byte{}, data[len(data)-shift:]...), data[:len(data)-shift]...)
+	}
+	return append(header, data...)
+}
+
+// unwrap 校验服务端发来的Wrap令牌，返回原始数据以及是否经过加密
+func (c *gssapiClient) unwrap(t *testing.T, token []byte) ([]byte, bool) {
+	if len(token) < wrapTokenHeaderLength || token[2]&wrapFlagSentByAcceptor == 0 {
+		t.Fatalf("Expect wrap token sent by acceptor")
+	}
+	if seq := binary.BigEndian.Uint64(token[8:16]); seq != c.recvSeq {
+		t.Fatalf("Unexpected sequence number %d, expect %d", seq, c.recvSeq)
+	}
+	c.recvSeq++
+
+	if token[2]&wrapFlagSealed == 0 {
+		var wrapToken gssapi.WrapToken
+		if err := wrapToken.Unmarshal(token, true); err != nil {
+			t.Fatalf("Unmarshal wrap token failed: %v", err)
+		}
+		if ok, err := wrapToken.Verify(c.key, keyusage.GSSAPI_ACCEPTOR_SEAL); !ok {
+			t.Fatalf("Verify wrap token failed: %v", err)
+		}
+		return wrapToken.Payload, false
+	}
+
+	plain, err := crypto.DecryptMessage(token[wrapTokenHeaderLength:], c.key, keyusage.GSSAPI_ACCEPTOR_SEAL)
+	if err != nil {
+		t.Fatalf("Decrypt wrap token failed: %v", err)
+	}
+	if !bytes.Equal(plain[len(plain)-wrapTokenHeaderLength:], token[:wrapTokenHeaderLength]) {
+		t.Fatalf("Wrap token header mismatch")
+	}
+	return plain[:len(plain)-wrapTokenHeaderLength], true
+}
+
+func (c *gssapiClient) send(t *testing.T, messageType uint8, token []byte) {
+	if err := writeGSSAPIMessage(c.conn, messageType, token); err != nil {
+		t.Fatalf("Write gssapi message failed: %v", err)
+	}
+}
+
+func (c *gssapiClient) receive(t *testing.T, messageType uint8) []byte {
+	token, err := readGSSAPIMessage(c.conn, messageType)
+	if err != nil {
+		t.Fatalf("Read gssapi message failed: %v", err)
+	}
+	return token
+}
+
+// marshalInitialContextToken InitialContextToken格式：OID | TOK_ID | KRB_AP_REQ
+func marshalInitialContextToken(apReq []byte) ([]byte, error) {
+	output, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	output = append(output, 0x01, 0x00)
+	output = append(output, apReq...)
+	return asn1tools.AddASNAppTag(output, 0), nil
+}
+
+type authResult struct {
+	identity *Identity
+	err      error
+}
+
+// startGSSAPIServer 在管道的服务端一端进行认证，返回两端的连接以及认证结果
+func startGSSAPIServer(t *testing.T, kdc *testKDC) (net.Conn, net.Conn, chan *authResult) {
+	mechanism, err := NewKerberosMechanism(kdc.keytabPath, "")
+	if err != nil {
+		t.Fatalf("NewKerberosMechanism failed: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	results := make(chan *authResult, 1)
+	go func() {
+		authenticator := &GSSAPIAuthenticator{Mechanism: mechanism}
+		identity, err := authenticator.Authenticate(context.Background(), serverConn, serverConn)
+		results <- &authResult{identity: identity, err: err}
+	}()
+	return serverConn, clientConn, results
+}
+
+func TestGSSAPIHandshake(t *testing.T) {
+	cases := []struct {
+		name       string
+		mutual     bool
+		level      uint8
+		rrc        int
+		protection uint8
+	}{
+		{name: "integrity", mutual: true, level: GSSAPIProtectionIntegrity, protection: GSSAPIProtectionIntegrity},
+		{name: "confidentiality", mutual: true, level: GSSAPIProtectionConfidentiality, protection: GSSAPIProtectionConfidentiality},
+		{name: "confidentiality without mutual", level: GSSAPIProtectionConfidentiality, rrc: 28, protection: GSSAPIProtectionConfidentiality},
+		{name: "selective", mutual: true, level: GSSAPIProtectionSelective, protection: GSSAPIProtectionConfidentiality},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			kdc := newTestKDC(t, "service-password")
+			ticket, sessionKey := kdc.ticket(t)
+			serverConn, clientConn, results := startGSSAPIServer(t, kdc)
+
+			client := &gssapiClient{conn: clientConn}
+			client.establish(t, ticket, sessionKey, tc.mutual)
+			if protection := client.negotiate(t, tc.level); protection != tc.protection {
+				t.Fatalf("Unexpected protection level %d, expect %d", protection, tc.protection)
+			}
+			result := <-results
+			if result.err != nil {
+				t.Fatalf("Authenticate failed: %v", result.err)
+			}
+			if result.identity.Username != testClientPrincipal+"@"+testRealm {
+				t.Fatalf("Unexpected username %s", result.identity.Username)
+			}
+			confidential := tc.protection == GSSAPIProtectionConfidentiality
+			conn := result.identity.Encapsulator.Encapsulate(serverConn)
+
+			// 客户端到服务端
+			request := []byte("GET / HTTP/1.1\r\n\r\n")
+			token := client.wrap(t, request, confidential, tc.rrc)
+			go func() {
+				_ = writeGSSAPIMessage(clientConn, gssapiMessageEncap, token)
+			}()
+			got := make([]byte, len(request))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("Read encapsulated data failed: %v", err)
+			}
+			if !bytes.Equal(got, request) {
+				t.Fatalf("Encapsulated request mismatch")
+			}
+
+			// 服务端到客户端，超过单个令牌的数据被拆分
+			response := bytes.Repeat([]byte("0123456789"), gssapiMaxPayloadChunk/10+1)
+			go func() {
+				_, _ = conn.Write(response)
+			}()
+			var received []byte
+			for len(received) < len(response) {
+				token := client.receive(t, gssapiMessageEncap)
+				if confidential && bytes.Contains(token, response[:32]) {
+					t.Fatalf("Payload is not encrypted")
+				}
+				payload, sealed := client.unwrap(t, token)
+				if sealed != confidential {
+					t.Fatalf("Unexpected protection of wrap token")
+				}
+				received = append(received, payload...)
+			}
+			if !bytes.Equal(received, response) {
+				t.Fatalf("Encapsulated response mismatch")
+			}
+		})
+	}
+}
+
+// 要求加密时，未加密的令牌被拒绝
+func TestGSSAPIRejectsUnsealedToken(t *testing.T) {
+	kdc := newTestKDC(t, "service-password")
+	ticket, sessionKey := kdc.ticket(t)
+	serverConn, clientConn, results := startGSSAPIServer(t, kdc)
+
+	client := &gssapiClient{conn: clientConn}
+	client.establish(t, ticket, sessionKey, true)
+	client.negotiate(t, GSSAPIProtectionConfidentiality)
+	result := <-results
+	if result.err != nil {
+		t.Fatalf("Authenticate failed: %v", result.err)
+	}
+	conn := result.identity.Encapsulator.Encapsulate(serverConn)
+
+	token := client.wrap(t, []byte("plain"), false, 0)
+	go func() {
+		_ = writeGSSAPIMessage(clientConn, gssapiMessageEncap, token)
+	}()
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatalf("Unsealed token should be rejected")
+	}
+}
+
+// 票据不是由keytab中的密钥签发时，服务端中止协商
+func TestGSSAPIRejectsUnknownKey(t *testing.T) {
+	ticket, sessionKey := newTestKDC(t, "another-password").ticket(t)
+	_, clientConn, results := startGSSAPIServer(t, newTestKDC(t, "service-password"))
+
+	client := &gssapiClient{conn: clientConn}
+	token, _ := client.initialToken(t, ticket, sessionKey, false)
+	go func() {
+		_ = writeGSSAPIMessage(clientConn, gssapiMessageAuth, token)
+	}()
+	abort := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, abort); err != nil {
+		t.Fatalf("Read abort failed: %v", err)
+	}
+	if abort[0] != gssapiVersion || abort[1] != gssapiMessageAbort {
+		t.Fatalf("Expect abort message, get %v", abort)
+	}
+	if result := <-results; result.err == nil {
+		t.Fatalf("Authenticate should fail")
+	}
+}
+
+// plainContext 不加密也不校验的安全上下文，用于测试不支持加密时的保护级别协商
+type plainContext struct{}
+
+func (c *plainContext) NewContext() GSSAPIContext {
+	return c
+}
+
+func (c *plainContext) Accept(token []byte) ([]byte, bool, error) {
+	return nil, true, nil
+}
+
+func (c *plainContext) SourceName() string {
+	return "plain"
+}
+
+func (c *plainContext) Wrap(payload []byte, confidential bool) ([]byte, error) {
+	return payload, nil
+}
+
+func (c *plainContext) Unwrap(token []byte) ([]byte, bool, error) {
+	return token, false, nil
+}
+
+func (c *plainContext) SupportsConfidentiality() bool {
+	return false
+}
+
+func TestGSSAPIProtectionLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level      uint8
+		protection uint8
+		abort      bool
+	}{
+		{level: GSSAPIProtectionIntegrity, protection: GSSAPIProtectionIntegrity},
+		{level: GSSAPIProtectionConfidentiality, protection: GSSAPIProtectionIntegrity},
+		{level: GSSAPIProtectionSelective, protection: GSSAPIProtectionIntegrity},
+		{level: 0, abort: true},
+		{level: 4, abort: true},
+	} {
+		serverConn, clientConn := net.Pipe()
+		results := make(chan *authResult, 1)
+		go func() {
+			authenticator := &GSSAPIAuthenticator{Mechanism: &plainContext{}}
+			identity, err := authenticator.Authenticate(context.Background(), serverConn, serverConn)
+			results <- &authResult{identity: identity, err: err}
+		}()
+
+		go func(level uint8) {
+			_ = writeGSSAPIMessage(clientConn, gssapiMessageAuth, []byte("token"))
+			_ = writeGSSAPIMessage(clientConn, gssapiMessageProtect, []byte{level})
+		}(tc.level)
+
+		if tc.abort {
+			abort := make([]byte, 2)
+			if _, err := io.ReadFull(clientConn, abort); err != nil {
+				t.Fatalf("Read abort failed: %v", err)
+			}
+			if abort[0] != gssapiVersion || abort[1] != gssapiMessageAbort {
+				t.Fatalf("Expect abort message for level %d, get %v", tc.level, abort)
+			}
+			if result := <-results; result.err == nil {
+				t.Fatalf("Authenticate with level %d should fail", tc.level)
+			}
+		} else {
+			selected, err := readGSSAPIMessage(clientConn, gssapiMessageProtect)
+			if err != nil {
+				t.Fatalf("Read protection level failed: %v", err)
+			}
+			if len(selected) != 1 || selected[0] != tc.protection {
+				t.Fatalf("Unexpected protection level %v for level %d, expect %d", selected, tc.level, tc.protection)
+			}
+			if result := <-results; result.err != nil {
+				t.Fatalf("Authenticate with level %d failed: %v", tc.level, result.err)
+			}
+		}
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	}
+}
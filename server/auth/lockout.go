@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5"
+)
+
+const (
+	BanTypeIP   = "ip"
+	BanTypeUser = "user"
+
+	// 认证失败后的延迟从lockoutBaseDelay开始逐次翻倍，最多不超过lockoutMaxDelay
+	lockoutBaseDelay = 500 * time.Millisecond
+	lockoutMaxDelay  = 16 * time.Second
+
+	// 失败记录超过该数量时，清理已经过期的记录
+	lockoutPruneThreshold = 4096
+)
+
+var (
+	BannedError = errors.New("Too many authentication failures, temporarily banned")
+)
+
+type clientIPKey struct{}
+
+// WithClientIP 将客户端地址放入ctx，供认证失败时按来源地址计数
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func ClientIPFrom(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientIPKey{}).(net.IP)
+	return ip
+}
+
+// Ban 被临时封禁的客户端地址或用户名
+type Ban struct {
+	Type     string    `json:"type"`
+	Value    string    `json:"value"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// Lockout 分别按客户端地址和用户名统计连续的认证失败次数，每次失败后延迟响应，达到阈值后临时封禁
+// 封禁记录保存在文件中，便于通过命令行查看和解除，文件修改后可通过Reload重新加载
+type Lockout struct {
+	Threshold   int
+	BanDuration time.Duration
+	filePath    string
+
+	lock    sync.Mutex
+	records map[string]*failureRecord
+
+	// 串行化封禁文件的写入，写入时不持有lock，避免文件IO阻塞其他连接的认证
+	saveLock sync.Mutex
+}
+
+func NewLockout(threshold int, banDuration time.Duration, filePath string) (*Lockout, error) {
+	lockout := &Lockout{
+		Threshold:   threshold,
+		BanDuration: banDuration,
+		filePath:    filePath,
+		records:     make(map[string]*failureRecord),
+	}
+	if err := lockout.Reload(); err != nil {
+		return nil, err
+	}
+	return lockout, nil
+}
+
+// Reload 以文件中的封禁记录为准，文件中已不存在的封禁视为被解除，尚未封禁的失败计数保持不变
+func (l *Lockout) Reload() error {
+	bans, err := LoadBans(l.filePath)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	records := make(map[string]*failureRecord, len(l.records)+len(bans))
+	for key, record := range l.records {
+		if now.After(record.bannedUntil) {
+			records[key] = record
+		}
+	}
+	for _, ban := range bans {
+		records[banKey(ban.Type, ban.Value)] = &failureRecord{
+			failures:    ban.Failures,
+			lastFailure: ban.Until.Add(-l.BanDuration),
+			bannedUntil: ban.Until,
+		}
+	}
+	l.records = records
+	return nil
+}
+
+// Check 客户端地址或用户名处于封禁期间时返回BannedError
+func (l *Lockout) Check(ip net.IP, username string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for _, key := range lockoutKeys(ip, username) {
+		if record, exist := l.records[key]; exist && now.Before(record.bannedUntil) {
+			return errors.Wrapf(BannedError, "%s until %s", key, record.bannedUntil.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Fail 记录一次认证失败，返回本次响应需要延迟的时间
+func (l *Lockout) Fail(ip net.IP, username string) time.Duration {
+	failures, banned := l.fail(ip, username)
+	if banned {
+		_ = l.save()
+	}
+
+	delay := lockoutBaseDelay
+	for i := 1; i < failures && delay < lockoutMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > lockoutMaxDelay {
+		delay = lockoutMaxDelay
+	}
+	return delay
+}
+
+// fail 更新失败计数，返回各计数中最大的失败次数，以及本次失败是否触发了新的封禁
+func (l *Lockout) fail(ip net.IP, username string) (int, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if len(l.records) >= lockoutPruneThreshold {
+		l.prune(now)
+	}
+
+	banned := false
+	failures := 0
+	for _, key := range lockoutKeys(ip, username) {
+		record, exist := l.records[key]
+
+		// 距离上次失败超过封禁时长后，重新开始计数
+		if !exist || now.Sub(record.lastFailure) > l.BanDuration {
+			record = &failureRecord{}
+			l.records[key] = record
+		}
+		record.failures++
+		record.lastFailure = now
+		if record.failures >= l.Threshold && now.After(record.bannedUntil) {
+			record.bannedUntil = now.Add(l.BanDuration)
+			banned = true
+		}
+		if record.failures > failures {
+			failures = record.failures
+		}
+	}
+	return failures, banned
+}
+
+// Succeed 认证成功后清空对应的失败计数
+func (l *Lockout) Succeed(ip net.IP, username string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, key := range lockoutKeys(ip, username) {
+		delete(l.records, key)
+	}
+}
+
+// prune 清理封禁结束且已经不再计数的记录，调用方需持有锁
+func (l *Lockout) prune(now time.Time) {
+	for key, record := range l.records {
+		if now.After(record.bannedUntil) && now.Sub(record.lastFailure) > l.BanDuration {
+			delete(l.records, key)
+		}
+	}
+}
+
+// save 将仍在封禁期间的记录写入文件，调用方不能持有lock
+// 在saveLock内重新获取快照，并发的写入按顺序进行，最后写入的总是最新的记录
+func (l *Lockout) save() error {
+	if len(l.filePath) == 0 {
+		return nil
+	}
+	l.saveLock.Lock()
+	defer l.saveLock.Unlock()
+	return SaveBans(l.filePath, l.snapshot(time.Now()))
+}
+
+// snapshot 复制仍在封禁期间的记录
+func (l *Lockout) snapshot(now time.Time) []*Ban {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var bans []*Ban
+	for key, record := range l.records {
+		if !now.Before(record.bannedUntil) {
+			continue
+		}
+		banType, value := parseBanKey(key)
+		bans = append(bans, &Ban{Type: banType, Value: value, Failures: record.failures, Until: record.bannedUntil})
+	}
+	return bans
+}
+
+func lockoutKeys(ip net.IP, username string) []string {
+	var keys []string
+	if ip != nil {
+		keys = append(keys, banKey(BanTypeIP, ip.String()))
+	}
+	if len(username) != 0 {
+		keys = append(keys, banKey(BanTypeUser, username))
+	}
+	return keys
+}
+
+func banKey(banType string, value string) string {
+	return fmt.Sprintf("%s:%s", banType, value)
+}
+
+func parseBanKey(key string) (string, string) {
+	index := strings.IndexByte(key, ':')
+	if index < 0 {
+		return "", key
+	}
+	return key[:index], key[index+1:]
+}
+
+// LoadBans 加载仍在封禁期间的记录，文件不存在时返回空
+func LoadBans(filePath string) ([]*Ban, error) {
+	if len(filePath) == 0 {
+		return nil, nil
+	}
+	bytes, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read bans file[%s]", filePath)
+	}
+	if len(bytes) == 0 {
+		return nil, nil
+	}
+
+	var bans []*Ban
+	if err := json.Unmarshal(bytes, &bans); err != nil {
+		return nil, errors.Wrapf(err, "Incorrect json format[%s]", filePath)
+	}
+
+	now := time.Now()
+	active := bans[:0]
+	for _, ban := range bans {
+		if now.Before(ban.Until) {
+			active = append(active, ban)
+		}
+	}
+	return active, nil
+}
+
+func SaveBans(filePath string, bans []*Ban) error {
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	if bans == nil {
+		bans = []*Ban{}
+	}
+	bytes, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Json marshal failed: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filePath, bytes, socks5.Perm0600); err != nil {
+		return errors.Wrapf(err, "Write bans file[%s] failed: %s", filePath, err.Error())
+	}
+	return nil
+}
@@ -1,11 +1,29 @@
 package auth
 
+import (
+	"context"
+	"io"
+)
+
 type NoAuthenticator struct{}
 
 func (a *NoAuthenticator) GetMethod() uint8 {
 	return NoAuthenticationMethod
 }
 
-func (a *NoAuthenticator) Authenticate(actual Authentication, expect Authentication) error {
-	return nil
+func (a *NoAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*Identity, error) {
+	return AnonymousIdentity(ctx), nil
+}
+
+type peerNameKey struct{}
+
+// WithPeerName 将TLS客户端证书中的名称放入ctx，无认证方式以其作为用户名，便于按用户配置访问策略
+func WithPeerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, peerNameKey{}, name)
+}
+
+// AnonymousIdentity 返回无认证方式的身份，连接使用了TLS客户端证书时以证书中的名称作为用户名
+func AnonymousIdentity(ctx context.Context) *Identity {
+	name, _ := ctx.Value(peerNameKey{}).(string)
+	return &Identity{Method: NoAuthenticationMethod, Username: name}
 }
@@ -1,21 +1,94 @@
 package auth
 
 import (
-	"strings"
+	"context"
+	"fmt"
+	"io"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-type UsernamePasswordAuthenticator struct{}
+const (
+	authVersion = uint8(1)
+	authSuccess = uint8(0)
+	authFailure = uint8(1)
+)
+
+type UsernamePasswordAuthenticator struct {
+	Store UserStore
+
+	// 为nil时不限制认证失败的次数
+	Lockout *Lockout
+}
 
 func (a *UsernamePasswordAuthenticator) GetMethod() uint8 {
 	return UsernamePasswordAuthenticationMethod
 }
 
-func (a *UsernamePasswordAuthenticator) Authenticate(actual Authentication, expect Authentication) error {
-	if strings.Compare(actual.Principle, expect.Principle) == 0 &&
-		strings.Compare(actual.Credentials, expect.Credentials) == 0 {
-		return nil
+func (a *UsernamePasswordAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*Identity, error) {
+	// 读取header部分，包含VER & ULEN，参考RFC 1929
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	// 确认认证协议的版本一致
+	if header[0] != authVersion {
+		return nil, errors.New(fmt.Sprintf("Unsupported auth version, expect %v, get %v", authVersion, header[0]))
+	}
+
+	// 读取用户名
+	username := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(reader, username); err != nil {
+		return nil, err
+	}
+
+	// 读取密码，复用header字节数组
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return nil, err
+	}
+	password := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(reader, password); err != nil {
+		return nil, err
+	}
+
+	// 校验认证结果，并写回给客户端
+	identity, err := a.Verify(ctx, string(username), string(password))
+	if err != nil {
+		_, _ = writer.Write([]byte{authVersion, authFailure})
+		return nil, err
+	}
+	if _, err := writer.Write([]byte{authVersion, authSuccess}); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Verify 校验用户名和密码，HTTP代理的Basic认证同样使用该方法
+func (a *UsernamePasswordAuthenticator) Verify(ctx context.Context, username string, password string) (*Identity, error) {
+	ip := ClientIPFrom(ctx)
+	if a.Lockout != nil {
+		if err := a.Lockout.Check(ip, username); err != nil {
+			return nil, errors.Wrapf(err, "Authentication rejected for user %s from %s", username, ip)
+		}
+	}
+
+	user, err := a.Store.Verify(username, password)
+	if err != nil {
+		// 延迟返回失败结果，降低暴力破解的速度
+		if a.Lockout != nil {
+			timer := time.NewTimer(a.Lockout.Fail(ip, username))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		return nil, errors.Wrapf(err, "Authentication failed for user %s from %s", username, ip)
+	}
+	if a.Lockout != nil {
+		a.Lockout.Succeed(ip, username)
 	}
-	return errors.New("auth failed")
+	return &Identity{Method: UsernamePasswordAuthenticationMethod, Username: user.Username, Groups: user.Groups}, nil
 }
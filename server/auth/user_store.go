@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/liruonian/socks5"
+)
+
+var (
+	UserNotFoundError    = errors.New("User not found")
+	UserDisabledError    = errors.New("User disabled")
+	InvalidPasswordError = errors.New("Invalid password")
+)
+
+// 用户不存在时同样进行一次bcrypt比较，使响应时间与密码错误时一致，避免据此探测用户名
+const dummyPasswordHash = "$2a$10$pfIkYizWdvwXE9foD1AbluVGRJYxFcWqyaUlv/h7gQ0gX8rdTAosu"
+
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Disabled     bool   `json:"disabled"`
+
+	// 用户所属的组，用于按组配置访问策略
+	Groups []string `json:"groups,omitempty"`
+}
+
+// UserStore 保存用户凭据，供USERNAME/PASSWORD认证方式校验
+type UserStore interface {
+	Verify(username string, password string) (*User, error)
+}
+
+// StaticUserStore 只包含配置文件中的单个用户
+type StaticUserStore struct {
+	Username string
+	Password string
+}
+
+func (s *StaticUserStore) Verify(username string, password string) (*User, error) {
+	if subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) != 1 {
+		return nil, UserNotFoundError
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) != 1 {
+		return nil, InvalidPasswordError
+	}
+	return &User{Username: username}, nil
+}
+
+// FileUserStore 从json文件中加载用户，密码以bcrypt哈希保存，文件修改后可通过Reload重新加载
+type FileUserStore struct {
+	filePath string
+	lock     sync.RWMutex
+	users    map[string]*User
+}
+
+func NewFileUserStore(filePath string) (*FileUserStore, error) {
+	store := &FileUserStore{filePath: filePath}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *FileUserStore) Reload() error {
+	users, err := LoadUsers(s.filePath)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]*User, len(users))
+	for _, user := range users {
+		index[user.Username] = user
+	}
+
+	s.lock.Lock()
+	s.users = index
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *FileUserStore) Verify(username string, password string) (*User, error) {
+	s.lock.RLock()
+	user, exist := s.users[username]
+	s.lock.RUnlock()
+
+	if !exist {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		return nil, InvalidPasswordError
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, InvalidPasswordError
+	}
+	if user.Disabled {
+		return nil, UserDisabledError
+	}
+	return user, nil
+}
+
+func LoadUsers(filePath string) ([]*User, error) {
+	bytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error occured while read users file[%s]", filePath)
+	}
+
+	var users []*User
+	if err := json.Unmarshal(bytes, &users); err != nil {
+		return nil, errors.Wrapf(err, "Incorrect json format[%s]", filePath)
+	}
+	return users, nil
+}
+
+func SaveUsers(filePath string, users []*User) error {
+	bytes, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Json marshal failed: %s", err.Error())
+	}
+
+	// 用户文件中包含密码哈希，仅允许当前用户读写
+	if err := ioutil.WriteFile(filePath, bytes, socks5.Perm0600); err != nil {
+		return errors.Wrapf(err, "Write users file[%s] failed: %s", filePath, err.Error())
+	}
+	return os.Chmod(filePath, socks5.Perm0600)
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+)
+
+func (s *server) handleBindRequest(conn net.Conn, request *Request) error {
+	// 在与TCP连接相同的网卡上监听，等待目的主机的入站连接
+	var bindIP net.IP
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bindIP = local.IP
+	}
+	listener, err := net.ListenTCP(socks5.Tcp, &net.TCPAddr{IP: bindIP})
+	if err != nil {
+		if err := request.reply(conn, generalSocksServerFailure, nil); err != nil {
+			return err
+		}
+		return err
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	// 第一次回复，告知客户端监听的地址和端口
+	bind := listener.Addr().(*net.TCPAddr)
+	if err := request.reply(conn, succeeded, &AddrSpec{IP: bind.IP, Port: bind.Port}); err != nil {
+		return err
+	}
+
+	// 只等待一个入站连接，超时后放弃
+	_ = listener.SetDeadline(time.Now().Add(s.config.GetBindTimeout()))
+	target, err := listener.AcceptTCP()
+	_ = listener.Close()
+	if err != nil {
+		if err := request.reply(conn, generalSocksServerFailure, nil); err != nil {
+			return err
+		}
+		return err
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	// 入站连接必须来自请求中的DST.ADDR
+	remote := target.RemoteAddr().(*net.TCPAddr)
+	dest := request.DestAddr
+	if len(dest.IP) != 0 && !dest.IP.IsUnspecified() && !dest.IP.Equal(remote.IP) {
+		if err := request.reply(conn, connectionNotAllowedByRuleset, nil); err != nil {
+			return err
+		}
+		return errors.New(fmt.Sprintf("Unexpected inbound connection from %s, expect %s", remote.IP, dest.IP))
+	}
+	logrus.Infof("Accepted inbound connection %s for bind address %s", remote.String(), bind.String())
+
+	// 第二次回复，告知客户端入站连接的来源地址
+	if err := request.reply(conn, succeeded, &AddrSpec{IP: remote.IP, Port: remote.Port}); err != nil {
+		return err
+	}
+
+	return splice(conn, request, target)
+}
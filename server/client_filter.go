@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+)
+
+// clientFilter 在读取任何协议数据之前，按照客户端地址决定是否接受连接
+type clientFilter struct {
+	// 被拒绝的连接数，放在首位以保证32位平台上原子操作的对齐要求
+	rejected uint64
+
+	config *Config
+
+	lock  sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newClientFilter(config *Config) (*clientFilter, error) {
+	filter := &clientFilter{config: config}
+	if err := filter.reload(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// reload 重新加载配置中的网段以及网段文件，任一文件有误时保留之前的列表
+func (f *clientFilter) reload() error {
+	allow, err := loadClientCIDRs(f.config.AllowedClients, f.config.AllowedClientsFile)
+	if err != nil {
+		return err
+	}
+	deny, err := loadClientCIDRs(f.config.DeniedClients, f.config.DeniedClientsFile)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.allow, f.deny = allow, deny
+	f.lock.Unlock()
+	return nil
+}
+
+// watch 网段文件发生变化时自动重新加载
+func (f *clientFilter) watch(ctx context.Context) {
+	for _, filePath := range []string{f.config.AllowedClientsFile, f.config.DeniedClientsFile} {
+		if len(filePath) == 0 {
+			continue
+		}
+		filePath := filePath
+		go socks5.WatchFile(ctx, filePath, clientsReloadInterval, func() {
+			if err := f.reload(); err != nil {
+				logrus.Errorf("Error occured while reload client list: %s", err.Error())
+				return
+			}
+			logrus.Infof("Client list reloaded from %s", filePath)
+		})
+	}
+}
+
+// accept 拒绝名单优先，允许名单不为空时客户端必须位于其中
+func (f *clientFilter) accept(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if socks5.ContainsIP(f.deny, tcpAddr.IP) {
+		return false
+	}
+	return len(f.allow) == 0 || socks5.ContainsIP(f.allow, tcpAddr.IP)
+}
+
+// reject 记录被拒绝的连接，返回累计的拒绝次数
+func (f *clientFilter) reject() uint64 {
+	return atomic.AddUint64(&f.rejected, 1)
+}
+
+// Rejected 返回累计被拒绝的连接数
+func (f *clientFilter) Rejected() uint64 {
+	return atomic.LoadUint64(&f.rejected)
+}
+
+func loadClientCIDRs(values []string, filePath string) ([]*net.IPNet, error) {
+	networks, err := socks5.ParseCIDRs(values)
+	if err != nil {
+		return nil, err
+	}
+	if len(filePath) != 0 {
+		loaded, err := socks5.LoadCIDRs(filePath)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, loaded...)
+	}
+	return networks, nil
+}
@@ -1,17 +1,123 @@
 package server
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+	"github.com/liruonian/socks5/server/auth"
+	"github.com/liruonian/socks5/server/resolver"
+	"github.com/liruonian/socks5/server/rule"
+)
+
+const (
+	defaultBindTimeout     = 60
+	defaultMaxAuthFailures = 5
+	defaultAuthBanDuration = 900
+
+	defaultResolverCacheSize   = 1024
+	defaultResolverCacheTTL    = 60
+	defaultResolverNegativeTTL = 30
+
+	defaultReverseListenHost = "127.0.0.1"
 )
 
 type Config struct {
 	Port     int    `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+
+	// 多用户凭据文件，配置后忽略Username和Password
+	UsersFile string `json:"users_file"`
+
+	// GSSAPI认证使用的keytab文件以及服务principal，principal为空时按照票据中的服务名称查找
+	GSSAPIKeytab           string `json:"gssapi_keytab"`
+	GSSAPIServicePrincipal string `json:"gssapi_service_principal"`
+
+	// 服务端接受的认证方式，按优先级排列，可选no_auth、gssapi、username_password
+	// 为空时，配置了凭据的认证方式必须使用，否则采用无认证模式
+	AuthMethods []string `json:"auth_methods"`
+
+	// BIND命令等待入站连接的超时时间，单位为秒
+	BindTimeout int `json:"bind_timeout"`
+
+	// 关闭同一端口上的SOCKS4/SOCKS4a支持
+	DisableSocks4 bool `json:"disable_socks4"`
+
+	// 关闭同一端口上的HTTP CONNECT及HTTP正向代理支持
+	DisableHTTP bool `json:"disable_http"`
+
+	// 关闭socks5-local的多路复用会话支持
+	DisableMux bool `json:"disable_mux"`
+
+	// 接受socks5-local的WebSocket隧道的路径，为空时不接受，例如/tunnel
+	WebSocketPath string `json:"websocket_path"`
+
+	// 关闭socks5-local的DNS over tunnel支持
+	DisableDNS bool `json:"disable_dns"`
+
+	// 反向隧道在服务端监听的地址，为空时只监听127.0.0.1，需要对外开放时配置为0.0.0.0，允许开放的端口在用户策略的reverse_ports中配置
+	ReverseListenHost string `json:"reverse_listen_host"`
+
+	// 解析目的域名的方式，可选system、udp、tcp、doh，默认为system
+	Resolver string `json:"resolver"`
+
+	// udp、tcp方式的DNS服务器，例如8.8.8.8:53，未指定端口时使用53；doh方式的地址，例如https://1.1.1.1/dns-query
+	// 多个服务器按顺序尝试
+	ResolverServers []string `json:"resolver_servers"`
+
+	// 静态解析，域名到IP列表的映射，优先于解析器
+	Hosts map[string][]string `json:"hosts"`
+
+	// 解析结果缓存的最大条目数，默认为1024，小于0时不缓存
+	ResolverCacheSize int `json:"resolver_cache_size"`
+
+	// 解析器未提供TTL时的缓存时长，以及域名不存在时的缓存时长，单位为秒，默认为60、30
+	ResolverCacheTTL    int `json:"resolver_cache_ttl"`
+	ResolverNegativeTTL int `json:"resolver_negative_ttl"`
+
+	// 目的地址访问规则，按顺序匹配，第一条匹配的规则生效
+	// 未配置时使用默认规则，禁止访问本机、链路本地及内网地址，配置为空数组表示不做限制
+	Rules []rule.Rule `json:"rules"`
+
+	// 没有规则匹配时的动作，可选allow、deny，默认为allow
+	DefaultAction string `json:"default_action"`
+
+	// 按用户或用户组配置的访问策略，限制可用的命令、目的地址以及登录来源，第一条匹配的策略生效
+	UserPolicies []rule.Policy `json:"user_policies"`
+
+	// 允许以及拒绝连接的客户端网段，支持IPv6，拒绝优先，允许名单为空时不做限制
+	// 网段文件每行一个网段或IP，修改后自动重新加载
+	AllowedClients     []string `json:"allowed_clients"`
+	AllowedClientsFile string   `json:"allowed_clients_file"`
+	DeniedClients      []string `json:"denied_clients"`
+	DeniedClientsFile  string   `json:"denied_clients_file"`
+
+	// 同一客户端地址或用户名连续认证失败达到该次数后临时封禁，负数表示不限制
+	MaxAuthFailures int `json:"max_auth_failures"`
+
+	// 认证失败封禁的时长，单位为秒
+	AuthBanDuration int `json:"auth_ban_duration"`
+
+	// 保存封禁记录的文件，为空时使用默认路径
+	BansFile string `json:"bans_file"`
+
+	// 与socks5-local之间的加密算法及预共享密钥，配置密钥后所有连接都需要加密
+	// 可选aes-128-gcm、aes-256-gcm、chacha20-poly1305，默认为chacha20-poly1305
+	Cipher string `json:"cipher"`
+	Key    string `json:"key"`
+
+	// 配置证书及私钥后，服务端在握手之前终止TLS
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// 校验客户端证书的CA，配置后要求客户端提供证书，证书中的CN作为无认证方式下的用户名
+	TLSClientCA string `json:"tls_client_ca"`
 }
 
 func (c *Config) ReadFrom(configFilePath string) error {
@@ -30,5 +136,146 @@ func (c *Config) Precheck() error {
 	if c.Port < 1024 {
 		return errors.New("Port must be greater than 1024")
 	}
+	for _, name := range c.AuthMethods {
+		if _, ok := auth.ParseMethod(name); !ok {
+			return errors.New(fmt.Sprintf("Unknown authentication method: %s", name))
+		}
+	}
+	if c.BindTimeout < 0 {
+		return errors.New("Bind timeout must not be negative")
+	}
+	if c.AuthBanDuration < 0 {
+		return errors.New("Auth ban duration must not be negative")
+	}
+	if len(c.Key) != 0 {
+		if err := proxy.CheckCipher(c.Cipher, c.Key); err != nil {
+			return err
+		}
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		return errors.New("Both tls certificate and key are required")
+	}
+	if len(c.WebSocketPath) != 0 && !strings.HasPrefix(c.WebSocketPath, "/") {
+		return errors.New("Websocket path must start with /")
+	}
+	if len(c.TLSClientCA) != 0 && len(c.TLSCert) == 0 {
+		return errors.New("Tls client ca requires tls certificate and key")
+	}
+	if _, err := c.NewRuleSet(); err != nil {
+		return err
+	}
+	if c.ResolverCacheTTL < 0 || c.ResolverNegativeTTL < 0 {
+		return errors.New("Resolver cache ttl must not be negative")
+	}
+	if _, err := c.NewResolver(); err != nil {
+		return err
+	}
+	if _, err := rule.NewPolicySet(c.UserPolicies); err != nil {
+		return err
+	}
+	if _, err := socks5.ParseCIDRs(c.AllowedClients); err != nil {
+		return err
+	}
+	if _, err := socks5.ParseCIDRs(c.DeniedClients); err != nil {
+		return err
+	}
 	return nil
 }
+
+func (c *Config) NewRuleSet() (*rule.RuleSet, error) {
+	if c.Rules == nil {
+		return rule.NewRuleSet(rule.DefaultRules(), c.DefaultAction)
+	}
+	return rule.NewRuleSet(c.Rules, c.DefaultAction)
+}
+
+// NewResolver 按照配置创建解析器，静态解析优先，其余域名由带缓存的解析器解析
+func (c *Config) NewResolver() (resolver.Resolver, error) {
+	var r resolver.Resolver
+	var err error
+	switch c.Resolver {
+	case "", resolver.TypeSystem:
+		r = &resolver.System{}
+	case resolver.TypeUDP, resolver.TypeTCP:
+		r, err = resolver.NewDNS(c.Resolver, c.ResolverServers)
+	case resolver.TypeDoH:
+		r, err = resolver.NewDoH(c.ResolverServers)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported resolver: %s", c.Resolver))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if size := c.GetResolverCacheSize(); size > 0 {
+		r = resolver.NewCache(r, size, c.GetResolverCacheTTL(), c.GetResolverNegativeTTL())
+	}
+	if len(c.Hosts) != 0 {
+		return resolver.NewHosts(c.Hosts, r)
+	}
+	return r, nil
+}
+
+// GetResolverCacheSize 返回解析结果缓存的条目上限，返回0表示不缓存
+func (c *Config) GetResolverCacheSize() int {
+	if c.ResolverCacheSize == 0 {
+		return defaultResolverCacheSize
+	}
+	if c.ResolverCacheSize < 0 {
+		return 0
+	}
+	return c.ResolverCacheSize
+}
+
+func (c *Config) GetResolverCacheTTL() time.Duration {
+	if c.ResolverCacheTTL == 0 {
+		return defaultResolverCacheTTL * time.Second
+	}
+	return time.Duration(c.ResolverCacheTTL) * time.Second
+}
+
+func (c *Config) GetResolverNegativeTTL() time.Duration {
+	if c.ResolverNegativeTTL == 0 {
+		return defaultResolverNegativeTTL * time.Second
+	}
+	return time.Duration(c.ResolverNegativeTTL) * time.Second
+}
+
+func (c *Config) GetBindTimeout() time.Duration {
+	if c.BindTimeout == 0 {
+		return defaultBindTimeout * time.Second
+	}
+	return time.Duration(c.BindTimeout) * time.Second
+}
+
+// GetMaxAuthFailures 返回认证失败的封禁阈值，返回0表示不限制
+func (c *Config) GetMaxAuthFailures() int {
+	if c.MaxAuthFailures == 0 {
+		return defaultMaxAuthFailures
+	}
+	if c.MaxAuthFailures < 0 {
+		return 0
+	}
+	return c.MaxAuthFailures
+}
+
+func (c *Config) GetAuthBanDuration() time.Duration {
+	if c.AuthBanDuration == 0 {
+		return defaultAuthBanDuration * time.Second
+	}
+	return time.Duration(c.AuthBanDuration) * time.Second
+}
+
+func (c *Config) GetReverseListenHost() string {
+	if len(c.ReverseListenHost) == 0 {
+		return defaultReverseListenHost
+	}
+	return c.ReverseListenHost
+}
+
+func (c *Config) GetBansFile() string {
+	if len(c.BansFile) == 0 {
+		return socks5.ServerSideBansPath
+	}
+	return c.BansFile
+}
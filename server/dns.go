@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5/proxy"
+	"github.com/liruonian/socks5/server/resolver"
+	"github.com/liruonian/socks5/server/rule"
+)
+
+const (
+	// DNS over tunnel连接的空闲超时，socks5-local会重新建立连接
+	dnsIdleTimeout = 60 * time.Second
+
+	// 解析器未提供TTL时，应答使用的TTL（秒）
+	dnsAnswerTTL = 60
+)
+
+// handleDNSRequest 回复之后，连接上的每个DNS查询报文都由服务端解析，并按顺序返回应答
+// A、AAAA记录由服务端的解析器解析，应答中被访问规则拒绝的地址会被过滤，其他类型的查询转发给解析器的上游
+func (s *server) handleDNSRequest(ctx context.Context, conn net.Conn, request *Request, policy *rule.Policy) error {
+	if s.config.DisableDNS {
+		if err := request.reply(conn, commandNotSupported, nil); err != nil {
+			return err
+		}
+		return errors.New("DNS over tunnel is disabled")
+	}
+	if policy != nil && !policy.AllowCommand(proxy.DNSCommand) {
+		if err := request.reply(conn, connectionNotAllowedByRuleset, nil); err != nil {
+			return err
+		}
+		return errors.Wrapf(notAllowedByRulesetError, "DNS over tunnel of user %s", request.Identity.String())
+	}
+	if err := request.reply(conn, succeeded, nil); err != nil {
+		return err
+	}
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		query, err := proxy.ReadDNSMessage(request.reader)
+		if err != nil {
+			// socks5-local关闭连接或连接空闲超时
+			if netErr, ok := err.(net.Error); err == io.EOF || (ok && netErr.Timeout()) {
+				return nil
+			}
+			return err
+		}
+
+		lookup := func(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+			return s.lookupAllowed(ctx, policy, name)
+		}
+		forward := func(ctx context.Context, query []byte) ([]byte, error) {
+			return resolver.Exchange(ctx, s.resolver, query)
+		}
+		answer, err := proxy.AnswerDNS(ctx, query, lookup, forward, dnsAnswerTTL)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid dns query from %s", conn.RemoteAddr().String())
+		}
+		if err := proxy.WriteDNSMessage(conn, answer); err != nil {
+			return err
+		}
+		logrus.Debugf("Answered dns query from %s", conn.RemoteAddr().String())
+	}
+}
+
+// lookupAllowed 解析域名，并去掉全局访问规则或用户策略不允许返回的地址，例如内网地址
+func (s *server) lookupAllowed(ctx context.Context, policy *rule.Policy, name string) ([]net.IP, time.Duration, error) {
+	ips, ttl, err := s.resolver.Resolve(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if s.ruleSet != nil && !s.ruleSet.AllowAnswer(ip) {
+			continue
+		}
+		if policy != nil && !policy.AllowAnswer(ip) {
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) != len(ips) {
+		logrus.Debugf("Filtered %d addresses of %s by rules", len(ips)-len(allowed), name)
+	}
+	return allowed, ttl, nil
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+	"github.com/liruonian/socks5/server/auth"
+)
+
+// 逐跳首部只在相邻节点之间有效，转发时需要移除
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpDestKey 请求上下文中保存已经按照用户策略及全局规则校验过的目的地址，建立连接时直接使用
+type httpDestKey struct{}
+
+func (s *server) newHTTPTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:               nil,
+		DialContext:         s.dialHTTPUpstream,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// 原样转发响应体，不做透明解压
+		DisableCompression: true,
+	}
+}
+
+func (s *server) handleHTTP(ctx context.Context, reader *bufio.Reader, conn net.Conn, allowTunnel bool) {
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				logrus.Errorf("Error occoured while read http request: %s", err.Error())
+			}
+			return
+		}
+
+		// socks5-local通过WebSocket建立的隧道，升级之后按照普通连接处理
+		if allowTunnel && len(s.config.WebSocketPath) != 0 && req.URL.Path == s.config.WebSocketPath && proxy.IsWebSocketUpgrade(req) {
+			s.handleWebSocket(ctx, req, reader, conn)
+			return
+		}
+
+		if s.config.DisableHTTP {
+			logrus.Errorf("Http proxy is disabled, reject connection from %s", conn.RemoteAddr().String())
+			return
+		}
+
+		identity, ok := s.httpAuthenticate(ctx, req)
+		if !ok {
+			_ = proxy.WriteHTTPStatus(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="` + socks5.ServerSideName + `"`},
+			})
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			s.handleHTTPConnect(ctx, identity, req, reader, conn)
+			return
+		}
+
+		if !req.URL.IsAbs() {
+			_ = proxy.WriteHTTPStatus(conn, http.StatusBadRequest, nil)
+			return
+		}
+		if !s.handleHTTPForward(ctx, identity, req, conn) {
+			return
+		}
+	}
+}
+
+// httpAuthenticate 使用与USERNAME/PASSWORD认证相同的凭据校验Proxy-Authorization，认证策略与socks5一致
+func (s *server) httpAuthenticate(ctx context.Context, req *http.Request) (*auth.Identity, bool) {
+	username, password, ok := proxy.ParseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		if s.authMethodAllowed(auth.NoAuthenticationMethod) {
+			return auth.AnonymousIdentity(ctx), true
+		}
+		return nil, false
+	}
+
+	if !s.authMethodAllowed(auth.UsernamePasswordAuthenticationMethod) {
+		return nil, false
+	}
+	verifier, ok := s.supportedAuthMethods[auth.UsernamePasswordAuthenticationMethod].(*auth.UsernamePasswordAuthenticator)
+	if !ok {
+		return nil, false
+	}
+	identity, err := verifier.Verify(ctx, username, password)
+	if err != nil {
+		logrus.Errorf("Error occoured while http authentication: %s", err.Error())
+		return nil, false
+	}
+	return identity, true
+}
+
+func (s *server) handleWebSocket(ctx context.Context, req *http.Request, reader *bufio.Reader, conn net.Conn) {
+	wsConn, err := proxy.AcceptWebSocket(conn, reader, req)
+	if err != nil {
+		logrus.Errorf("Error occoured while upgrade websocket from %s: %s", conn.RemoteAddr().String(), err.Error())
+		_ = proxy.WriteHTTPStatus(conn, http.StatusBadRequest, nil)
+		return
+	}
+	defer func() {
+		_ = wsConn.Close()
+	}()
+
+	// WebSocket隧道之内同样需要按照预共享密钥解密
+	var tunnel net.Conn = wsConn
+	if s.cipher != nil {
+		tunnel = proxy.NewSecureConn(wsConn, s.cipher)
+	}
+	s.serve(withTunnel(ctx), tunnel, true)
+}
+
+func (s *server) handleHTTPConnect(ctx context.Context, identity *auth.Identity, req *http.Request, reader *bufio.Reader, conn net.Conn) {
+	dest, err := parseHostPort(req.Host, 443)
+	if err != nil {
+		_ = proxy.WriteHTTPStatus(conn, http.StatusBadRequest, nil)
+		return
+	}
+
+	request := &Request{
+		Command:    ConnectCommand,
+		RemoteAddr: clientAddrSpec(conn),
+		DestAddr:   dest,
+		Identity:   identity,
+		reader:     reader,
+		replyFunc:  sendHTTPConnectReply,
+	}
+	if err := s.handleRequest(ctx, request, conn); err != nil {
+		logrus.Errorf("Error occoured while handle request: %s", err.Error())
+	}
+}
+
+// handleHTTPForward 转发绝对URI形式的请求，返回值表示连接是否可以继续复用
+func (s *server) handleHTTPForward(ctx context.Context, identity *auth.Identity, req *http.Request, conn net.Conn) bool {
+	// 连接池中的连接由不同用户共享，转发之前需要按照当前用户的策略校验
+	dest, err := s.authorizeHTTPForward(ctx, identity, req, conn)
+	if err != nil {
+		logrus.Errorf("Error occoured while forward http request to %s: %s", req.URL.Host, err.Error())
+		if errors.Is(err, notAllowedByRulesetError) {
+			_ = proxy.WriteHTTPStatus(conn, http.StatusForbidden, nil)
+		} else {
+			_ = proxy.WriteHTTPStatus(conn, http.StatusBadGateway, nil)
+		}
+		return false
+	}
+
+	keepAlive := !req.Close
+	removeHopByHopHeaders(req.Header)
+	req.RequestURI = ""
+
+	// 连接池按照地址复用连接，http请求改用校验过的IP作为地址，Host首部保持不变，
+	// https请求需要使用原始域名校验证书，因此不复用连接，避免复用到其他IP的连接
+	if req.URL.Scheme == "https" {
+		req.Close = true
+	} else {
+		req.URL.Host = net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port))
+	}
+	req = req.WithContext(context.WithValue(ctx, httpDestKey{}, dest))
+
+	resp, err := s.httpTransport.RoundTrip(req)
+	if err != nil {
+		logrus.Errorf("Error occoured while forward http request to %s: %s", req.URL.Host, err.Error())
+		if errors.Is(err, notAllowedByRulesetError) {
+			_ = proxy.WriteHTTPStatus(conn, http.StatusForbidden, nil)
+			return false
+		}
+		_ = proxy.WriteHTTPStatus(conn, http.StatusBadGateway, nil)
+		return false
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	removeHopByHopHeaders(resp.Header)
+	if err := resp.Write(conn); err != nil {
+		logrus.Errorf("Error occoured while write http response: %s", err.Error())
+		return false
+	}
+
+	// 响应体长度未知时只能通过关闭连接来结束
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		return false
+	}
+	return keepAlive && !resp.Close
+}
+
+// authorizeHTTPForward 只解析一次目的地址，按照用户策略及全局规则校验后返回，转发时连接该地址
+func (s *server) authorizeHTTPForward(ctx context.Context, identity *auth.Identity, req *http.Request, conn net.Conn) (*AddrSpec, error) {
+	policy := s.lookupPolicy(identity)
+	if !s.sourceAllowed(policy, clientAddrSpec(conn)) {
+		return nil, errors.Wrapf(notAllowedByRulesetError, "User %s from %s", identity.String(), conn.RemoteAddr().String())
+	}
+
+	defaultPort := 80
+	if req.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	dest, err := parseHostPort(req.URL.Host, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+	if dest.FQDN != "" {
+		_, addr, err := s.resolve(ctx, dest.FQDN)
+		if err != nil {
+			return nil, err
+		}
+		dest.IP = addr
+	}
+	if !s.allowed(policy, ConnectCommand, dest) {
+		return nil, errors.Wrapf(notAllowedByRulesetError, "Request to %s", dest.Address())
+	}
+	return dest, nil
+}
+
+// dialHTTPUpstream 连接authorizeHTTPForward校验过的地址，不再重新解析，没有校验过的地址时拒绝连接
+func (s *server) dialHTTPUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	dest, ok := ctx.Value(httpDestKey{}).(*AddrSpec)
+	if !ok || dest.IP == nil {
+		return nil, errors.Wrapf(notAllowedByRulesetError, "Unchecked request to %s", address)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port)))
+}
+
+func sendHTTPConnectReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	switch resp {
+	case succeeded:
+		_, err := w.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return err
+	case connectionNotAllowedByRuleset:
+		return proxy.WriteHTTPStatus(w, http.StatusForbidden, nil)
+	case commandNotSupported, addressTypeNotSupported:
+		return proxy.WriteHTTPStatus(w, http.StatusBadRequest, nil)
+	case ttlExpired:
+		return proxy.WriteHTTPStatus(w, http.StatusGatewayTimeout, nil)
+	default:
+		return proxy.WriteHTTPStatus(w, http.StatusBadGateway, nil)
+	}
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	// Connection首部中列出的字段同样是逐跳首部
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+func parseHostPort(hostport string, defaultPort int) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+		portStr = strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New(fmt.Sprintf("Invalid port in address %s", hostport))
+	}
+
+	addr := &AddrSpec{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP = ip
+	} else {
+		addr.FQDN = host
+	}
+	return addr, nil
+}
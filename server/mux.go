@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5/proxy"
+)
+
+// handleMux 处理socks5-local建立的多路复用会话，会话中的每条逻辑连接都是一个独立的代理请求
+func (s *server) handleMux(ctx context.Context, conn net.Conn) {
+	if s.config.DisableMux {
+		logrus.Errorf("Multiplexing is disabled, reject connection from %s", conn.RemoteAddr().String())
+		return
+	}
+
+	session, err := proxy.NewMuxServer(conn, proxy.NewMuxConfig(0))
+	if err != nil {
+		logrus.Errorf("Error occoured while setup mux session: %s", err.Error())
+		return
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	// 服务停止时关闭会话，使Accept返回
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	logrus.Infof("Mux session established from %s", conn.RemoteAddr().String())
+	ctx = withMuxStream(withTunnel(ctx))
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			logrus.Infof("Mux session from %s closed: %s", conn.RemoteAddr().String(), err.Error())
+			return
+		}
+		go func() {
+			defer func() {
+				_ = stream.Close()
+			}()
+			s.serve(ctx, stream, false)
+		}()
+	}
+}
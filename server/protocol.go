@@ -1,11 +1,10 @@
 package server
 
 const (
+	socks4Version = uint8(4)
 	socks5Version = uint8(5)
 
-	authVersion = uint8(1)
-	authSuccess = uint8(0)
-	authFailure = uint8(1)
+	noAcceptableMethods = uint8(0xff)
 
 	ipv4Address = uint8(1)
 	fqdnAddress = uint8(3)
@@ -27,3 +26,10 @@ const (
 	commandNotSupported
 	addressTypeNotSupported
 )
+
+const (
+	socks4ReplyVersion = uint8(0)
+
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+)
@@ -3,8 +3,13 @@ package server
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5/server/auth"
 )
 
 type AddrSpec struct {
@@ -32,5 +37,94 @@ type Request struct {
 	Command    uint8
 	RemoteAddr *AddrSpec
 	DestAddr   *AddrSpec
+	Identity   *auth.Identity
 	reader     *bufio.Reader
+
+	// 不同协议的回复格式不同，由解析请求的一方指定
+	replyFunc func(w io.Writer, resp uint8, addr *AddrSpec) error
+}
+
+func (r *Request) reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	return r.replyFunc(w, resp, addr)
+}
+
+// readAddrSpec 读取ATYP | DST.ADDR | DST.PORT格式的地址，请求和UDP报文头共用该格式
+func readAddrSpec(reader io.Reader) (*AddrSpec, error) {
+	addr := &AddrSpec{}
+	atyp := []byte{0}
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return nil, err
+	}
+	switch atyp[0] {
+	case ipv4Address:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, err
+		}
+		addr.IP = net.IP(ip)
+	case ipv6Address:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, err
+		}
+		addr.IP = net.IP(ip)
+	case fqdnAddress:
+		if _, err := io.ReadFull(reader, atyp); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, int(atyp[0]))
+		if _, err := io.ReadFull(reader, fqdn); err != nil {
+			return nil, err
+		}
+		addr.FQDN = string(fqdn)
+	default:
+		return nil, addressTypeNotSupportedError
+	}
+
+	// 获取端口信息
+	port := []byte{0, 0}
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, err
+	}
+	addr.Port = (int(port[0]) << 8) | int(port[1])
+
+	return addr, nil
+}
+
+// encodeAddrSpec 将地址编码为ATYP | ADDR | PORT格式，addr为nil时编码为0.0.0.0:0
+func encodeAddrSpec(addr *AddrSpec) ([]byte, error) {
+	var addrType uint8
+	var addrBody []byte
+	var addrPort uint16
+	switch {
+	case addr == nil:
+		addrType = ipv4Address
+		addrBody = []byte{0, 0, 0, 0}
+		addrPort = 0
+
+	case addr.FQDN != "":
+		addrType = fqdnAddress
+		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
+		addrPort = uint16(addr.Port)
+
+	case addr.IP.To4() != nil:
+		addrType = ipv4Address
+		addrBody = []byte(addr.IP.To4())
+		addrPort = uint16(addr.Port)
+
+	case addr.IP.To16() != nil:
+		addrType = ipv6Address
+		addrBody = []byte(addr.IP.To16())
+		addrPort = uint16(addr.Port)
+
+	default:
+		return nil, errors.New(fmt.Sprintf("Failed to format address: %v", addr))
+	}
+
+	msg := make([]byte, 3+len(addrBody))
+	msg[0] = addrType
+	copy(msg[1:], addrBody)
+	msg[1+len(addrBody)] = byte(addrPort >> 8)
+	msg[1+len(addrBody)+1] = byte(addrPort & 0xff)
+	return msg, nil
 }
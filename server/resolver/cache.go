@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Cache 按域名缓存解析结果，遵循解析器返回的TTL，域名不存在时同样缓存，达到上限时淘汰最久未使用的条目
+type Cache struct {
+	Resolver Resolver
+	Size     int
+
+	// 解析器未提供TTL时的缓存时长，以及域名不存在时的缓存时长
+	DefaultTTL  time.Duration
+	NegativeTTL time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	name   string
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+func NewCache(r Resolver, size int, defaultTTL time.Duration, negativeTTL time.Duration) *Cache {
+	return &Cache{
+		Resolver:    r,
+		Size:        size,
+		DefaultTTL:  defaultTTL,
+		NegativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// Resolve 命中缓存时返回剩余的TTL，其他解析错误不缓存
+func (c *Cache) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ips := literalIP(name); ips != nil {
+		return ips, 0, nil
+	}
+	key := normalizeName(name)
+	if entry := c.get(key); entry != nil {
+		return entry.ips, time.Until(entry.expire), entry.err
+	}
+
+	ips, ttl, err := c.Resolver.Resolve(ctx, name)
+	switch {
+	case err == nil:
+		if ttl <= 0 {
+			ttl = c.DefaultTTL
+		}
+	case IsNotFound(err):
+		ttl = c.NegativeTTL
+	default:
+		return nil, 0, err
+	}
+	if ttl > 0 {
+		c.put(&cacheEntry{name: key, ips: ips, err: err, expire: time.Now().Add(ttl)})
+	}
+	return ips, ttl, err
+}
+
+func (c *Cache) get(key string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exist := c.entries[key]
+	if !exist {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+func (c *Cache) put(entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exist := c.entries[entry.name]; exist {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	for c.lru.Len() >= c.Size && c.lru.Len() > 0 {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).name)
+	}
+	c.entries[entry.name] = c.lru.PushFront(entry)
+}
+
+func (c *Cache) Watch(ctx context.Context) {
+	Watch(ctx, c.Resolver)
+}
+
+// Exchange 转发的查询不缓存
+func (c *Cache) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return Exchange(ctx, c.Resolver, query)
+}
@@ -0,0 +1,143 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type stubAnswer struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// stubResolver 按域名返回预设的结果，并记录每个域名的查询次数
+type stubResolver struct {
+	answers map[string]*stubAnswer
+
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func newStubResolver(answers map[string]*stubAnswer) *stubResolver {
+	return &stubResolver{answers: answers, calls: make(map[string]int)}
+}
+
+func (r *stubResolver) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	r.lock.Lock()
+	r.calls[name]++
+	r.lock.Unlock()
+
+	answer, exist := r.answers[name]
+	if !exist {
+		return nil, 0, notFoundError(name, "stub")
+	}
+	return answer.ips, answer.ttl, answer.err
+}
+
+func (r *stubResolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return append([]byte("answer:"), query...), nil
+}
+
+func (r *stubResolver) count(name string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.calls[name]
+}
+
+func TestCache(t *testing.T) {
+	stub := newStubResolver(map[string]*stubAnswer{
+		"a.example":      {ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Hour},
+		"notttl.example": {ips: []net.IP{net.ParseIP("192.0.2.2")}},
+		"fail.example":   {err: errors.New("connection refused")},
+	})
+	cache := NewCache(stub, 16, time.Minute, 10*time.Second)
+
+	for _, item := range []struct {
+		name     string
+		query    string
+		calls    int
+		ttl      time.Duration
+		notFound bool
+		err      bool
+	}{
+		{name: "first query", query: "a.example", calls: 1, ttl: time.Hour},
+		{name: "cached", query: "a.example", calls: 1, ttl: time.Hour},
+		{name: "case and trailing dot", query: "A.Example.", calls: 1, ttl: time.Hour},
+		{name: "default ttl", query: "notttl.example", calls: 1, ttl: time.Minute},
+		{name: "default ttl cached", query: "notttl.example", calls: 1, ttl: time.Minute},
+		{name: "negative", query: "missing.example", calls: 1, ttl: 10 * time.Second, notFound: true},
+		{name: "negative cached", query: "missing.example", calls: 1, ttl: 10 * time.Second, notFound: true},
+		{name: "other errors", query: "fail.example", calls: 1, err: true},
+		{name: "other errors not cached", query: "fail.example", calls: 2, err: true},
+		{name: "literal ip", query: "198.51.100.1", calls: 0},
+	} {
+		ips, ttl, err := cache.Resolve(context.Background(), item.query)
+		if calls := stub.count(normalizeName(item.query)); calls != item.calls {
+			t.Fatalf("%s: resolver called %d times, expect %d", item.name, calls, item.calls)
+		}
+		if item.err || item.notFound {
+			if err == nil || IsNotFound(err) != item.notFound {
+				t.Fatalf("%s: unexpected error %v", item.name, err)
+			}
+		} else if err != nil || len(ips) != 1 {
+			t.Fatalf("%s: Resolve failed: %v %v", item.name, ips, err)
+		}
+		// 命中缓存时返回剩余的TTL
+		if ttl > item.ttl || ttl < item.ttl-time.Second {
+			t.Fatalf("%s: unexpected ttl %s, expect %s", item.name, ttl, item.ttl)
+		}
+	}
+
+	// 过期的条目重新解析
+	cache.entries["a.example"].Value.(*cacheEntry).expire = time.Now().Add(-time.Second)
+	if _, _, err := cache.Resolve(context.Background(), "a.example"); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if calls := stub.count("a.example"); calls != 2 {
+		t.Fatalf("Expired entry resolved %d times, expect 2", calls)
+	}
+
+	if answer, err := cache.Exchange(context.Background(), []byte("query")); err != nil || string(answer) != "answer:query" {
+		t.Fatalf("Exchange returned %q %v", answer, err)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	answers := make(map[string]*stubAnswer)
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		answers[name] = &stubAnswer{ips: []net.IP{net.ParseIP("192.0.2.1")}, ttl: time.Hour}
+	}
+	stub := newStubResolver(answers)
+	cache := NewCache(stub, 2, time.Minute, time.Minute)
+
+	for _, item := range []struct {
+		query string
+		calls int
+	}{
+		{query: "a.example", calls: 1},
+		{query: "b.example", calls: 1},
+		{query: "a.example", calls: 1},
+		// a最近使用过，c加入时淘汰b
+		{query: "c.example", calls: 1},
+		{query: "a.example", calls: 1},
+		{query: "b.example", calls: 2},
+		// b重新加入时淘汰c
+		{query: "c.example", calls: 2},
+	} {
+		if _, _, err := cache.Resolve(context.Background(), item.query); err != nil {
+			t.Fatalf("Resolve %s failed: %v", item.query, err)
+		}
+		if calls := stub.count(item.query); calls != item.calls {
+			t.Fatalf("%s resolved %d times, expect %d", item.query, calls, item.calls)
+		}
+		if len(cache.entries) > 2 || cache.lru.Len() != len(cache.entries) {
+			t.Fatalf("Cache holds %d entries and %d lru elements, expect at most 2", len(cache.entries), cache.lru.Len())
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/liruonian/socks5/proxy"
+)
+
+const (
+	defaultDNSPort = "53"
+
+	// 向单个服务器查询的超时时间
+	exchangeTimeout = 5 * time.Second
+
+	maxMessageSize = 0xffff
+)
+
+// exchangeFunc 向服务器发送一个查询报文并返回应答报文
+type exchangeFunc func(ctx context.Context, server string, query []byte) ([]byte, error)
+
+// DNS 向指定的DNS服务器查询A及AAAA记录，udp应答被截断时改用tcp，多个服务器按顺序尝试
+type DNS struct {
+	Network string
+	Servers []string
+}
+
+// NewDNS 服务器地址未指定端口时使用53端口
+func NewDNS(network string, servers []string) (*DNS, error) {
+	if network != TypeUDP && network != TypeTCP {
+		return nil, errors.New(fmt.Sprintf("Unsupported dns network: %s", network))
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("DNS servers should not be empty")
+	}
+	r := &DNS{Network: network}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, defaultDNSPort)
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, errors.Wrapf(err, "Invalid dns server[%s]", server)
+		}
+		r.Servers = append(r.Servers, server)
+	}
+	return r, nil
+}
+
+func (r *DNS) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	return resolveServers(ctx, name, r.Servers, true, r.exchange)
+}
+
+func (r *DNS) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return exchangeServers(ctx, r.Servers, query, r.exchange)
+}
+
+func (r *DNS) exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	answer, err := exchangeConn(ctx, r.Network, server, query)
+	if err != nil || r.Network != TypeUDP {
+		return answer, err
+	}
+	var parser dnsmessage.Parser
+	if header, err := parser.Start(answer); err == nil && header.Truncated {
+		return exchangeConn(ctx, TypeTCP, server, query)
+	}
+	return answer, nil
+}
+
+// exchangeConn udp查询忽略ID不匹配的报文，tcp查询使用两字节长度前缀
+func exchangeConn(ctx context.Context, network string, server string, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == TypeTCP {
+		if err := proxy.WriteDNSMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return proxy.ReadDNSMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(query) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeServers 按顺序向各服务器转发查询报文，直到某个服务器返回应答
+func exchangeServers(ctx context.Context, servers []string, query []byte, exchange exchangeFunc) ([]byte, error) {
+	var lastErr error
+	for _, server := range servers {
+		exchangeCtx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+		answer, err := exchange(exchangeCtx, server, query)
+		cancel()
+		if err == nil {
+			return answer, nil
+		}
+		lastErr = errors.Wrapf(err, "Forward query to %s failed", server)
+	}
+	return nil, lastErr
+}
+
+// resolveServers 按顺序向各服务器查询，成功或确认域名不存在时不再尝试其他服务器，IP地址不发出查询
+func resolveServers(ctx context.Context, name string, servers []string, randomID bool, exchange exchangeFunc) ([]net.IP, time.Duration, error) {
+	if ips := literalIP(name); ips != nil {
+		return ips, 0, nil
+	}
+	var lastErr error
+	for _, server := range servers {
+		ips, ttl, err := resolveServer(ctx, name, server, randomID, exchange)
+		if err == nil || IsNotFound(err) {
+			return ips, ttl, err
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+type lookupResult struct {
+	ips []net.IP
+	ttl uint32
+	err error
+}
+
+// resolveServer 同时查询A和AAAA记录，任一类型有地址即视为成功，TTL取所有记录中最小的值
+func resolveServer(ctx context.Context, name string, server string, randomID bool, exchange exchangeFunc) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan *lookupResult, len(types))
+	for _, qtype := range types {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := lookupType(ctx, name, qtype, server, randomID, exchange)
+			results <- &lookupResult{ips: ips, ttl: ttl, err: err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var minTTL uint32
+	var lastErr error
+	for range types {
+		result := <-results
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		if len(result.ips) != 0 && (len(ips) == 0 || result.ttl < minTTL) {
+			minTTL = result.ttl
+		}
+		ips = append(ips, result.ips...)
+	}
+	if len(ips) != 0 {
+		return ips, time.Duration(minTTL) * time.Second, nil
+	}
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return nil, 0, notFoundError(name, server)
+}
+
+func lookupType(ctx context.Context, name string, qtype dnsmessage.Type, server string, randomID bool, exchange exchangeFunc) ([]net.IP, uint32, error) {
+	query, err := newQuery(name, qtype, randomID)
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err := exchange(ctx, server, query)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Query %s from %s failed", name, server)
+	}
+
+	ips, ttl, rcode, err := proxy.ParseDNSAnswer(answer)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "Invalid dns answer from %s", server)
+	}
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return ips, ttl, nil
+	case dnsmessage.RCodeNameError:
+		return nil, 0, notFoundError(name, server)
+	default:
+		return nil, 0, errors.New(fmt.Sprintf("DNS server %s returned %s for %s", server, rcode.String(), name))
+	}
+}
+
+// newQuery DNS over HTTPS建议使用0作为ID以便HTTP缓存，其他方式使用随机ID
+func newQuery(name string, qtype dnsmessage.Type, randomID bool) ([]byte, error) {
+	var id uint16
+	if randomID {
+		buf := make([]byte, 2)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		id = binary.BigEndian.Uint16(buf)
+	}
+	return proxy.NewDNSQuery(normalizeName(name), qtype, id)
+}
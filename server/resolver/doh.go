@@ -0,0 +1,82 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const dohContentType = "application/dns-message"
+
+// DoH 通过DNS over HTTPS（RFC 8484）以POST方式查询，多个地址按顺序尝试
+type DoH struct {
+	URLs   []string
+	Client *http.Client
+}
+
+func NewDoH(urls []string) (*DoH, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("DoH urls should not be empty")
+	}
+	for _, item := range urls {
+		u, err := url.Parse(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid doh url[%s]", item)
+		}
+		// 明文的http会泄露查询内容并且可以被篡改，只允许https
+		if u.Scheme != "https" || len(u.Host) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid doh url[%s], expect https", item))
+		}
+	}
+	return &DoH{URLs: urls, Client: &http.Client{Timeout: exchangeTimeout}}, nil
+}
+
+func (r *DoH) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	return resolveServers(ctx, name, r.URLs, false, r.exchange)
+}
+
+// Exchange 查询使用0作为ID以便HTTP缓存，应答的ID还原为原始查询的ID
+func (r *DoH) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("DNS query too short")
+	}
+	request := append([]byte{0, 0}, query[2:]...)
+	answer, err := exchangeServers(ctx, r.URLs, request, r.exchange)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 2 {
+		return nil, errors.New("DNS answer too short")
+	}
+	copy(answer, query[:2])
+	return answer, nil
+}
+
+func (r *DoH) exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Unexpected status of doh response: %s", resp.Status))
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
@@ -0,0 +1,234 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+)
+
+const (
+	TypeSystem = "system"
+	TypeUDP    = "udp"
+	TypeTCP    = "tcp"
+	TypeDoH    = "doh"
+
+	resolvConfPath = "/etc/resolv.conf"
+
+	// 检查resolv.conf是否发生变化的间隔
+	resolvConfReloadInterval = 5 * time.Second
+)
+
+// Resolver 解析域名的所有IP地址，ttl为结果可以缓存的时长，为0表示解析器无法提供TTL
+// 域名不存在时返回IsNotFound为true的*net.DNSError
+type Resolver interface {
+	Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error)
+}
+
+// Exchanger 可以向上游转发原始查询报文的解析器，用于A、AAAA以外类型的查询
+type Exchanger interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// Exchange 使用解析器的上游转发查询报文，解析器不支持转发时返回错误
+func Exchange(ctx context.Context, r Resolver, query []byte) ([]byte, error) {
+	exchanger, ok := r.(Exchanger)
+	if !ok {
+		return nil, errors.New("Resolver does not support forwarding queries")
+	}
+	return exchanger.Exchange(ctx, query)
+}
+
+// Watcher 依赖外部文件的解析器，文件发生变化时自动重新加载，直到ctx结束
+type Watcher interface {
+	Watch(ctx context.Context)
+}
+
+// Watch 解析器依赖外部文件时开始监视文件的变化，否则直接返回
+func Watch(ctx context.Context, r Resolver) {
+	if watcher, ok := r.(Watcher); ok {
+		watcher.Watch(ctx)
+	}
+}
+
+// IsNotFound 判断错误是否表示域名不存在
+func IsNotFound(err error) bool {
+	dnsErr, ok := errors.Cause(err).(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func notFoundError(name string, server string) error {
+	return &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+}
+
+// literalIP name本身是IP地址时直接返回，不需要查询也不需要缓存
+func literalIP(name string) []net.IP {
+	if ip := net.ParseIP(strings.Trim(name, "[]")); ip != nil {
+		return []net.IP{ip}
+	}
+	return nil
+}
+
+// normalizeName 域名不区分大小写，忽略末尾的点
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// System 使用操作系统的解析器，不提供TTL，转发查询时使用resolv.conf中的服务器
+// resolv.conf在第一次转发查询时读取，之后只在文件发生变化时重新加载
+type System struct {
+	// resolv.conf的路径，为空时使用/etc/resolv.conf
+	filePath string
+
+	lock     sync.Mutex
+	loaded   bool
+	upstream *DNS
+	err      error
+}
+
+func (r *System) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, 0, nil
+}
+
+func (r *System) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	upstream, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return upstream.Exchange(ctx, query)
+}
+
+// Reload 重新读取resolv.conf，读取失败时保留原有的服务器
+func (r *System) Reload() error {
+	upstream, err := r.readUpstream()
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.loaded, r.upstream, r.err = true, upstream, nil
+	r.lock.Unlock()
+	return nil
+}
+
+// Watch resolv.conf发生变化时重新加载
+func (r *System) Watch(ctx context.Context) {
+	filePath := r.resolvConfPath()
+	go socks5.WatchFile(ctx, filePath, resolvConfReloadInterval, func() {
+		if err := r.Reload(); err != nil {
+			logrus.Errorf("Error occured while reload nameservers: %s", err.Error())
+			return
+		}
+		logrus.Infof("Nameservers reloaded from %s", filePath)
+	})
+}
+
+func (r *System) load() (*DNS, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.loaded {
+		r.upstream, r.err = r.readUpstream()
+		r.loaded = true
+	}
+	return r.upstream, r.err
+}
+
+func (r *System) readUpstream() (*DNS, error) {
+	servers, err := readResolvConf(r.resolvConfPath())
+	if err != nil {
+		return nil, err
+	}
+	return NewDNS(TypeUDP, servers)
+}
+
+func (r *System) resolvConfPath() string {
+	if len(r.filePath) == 0 {
+		return resolvConfPath
+	}
+	return r.filePath
+}
+
+// readResolvConf 读取resolv.conf中的nameserver
+func readResolvConf(filePath string) ([]string, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New(fmt.Sprintf("No nameserver found in %s", filePath))
+	}
+	return servers, nil
+}
+
+// Hosts 静态解析，未配置的域名交给Next解析，Next为nil时视为域名不存在
+type Hosts struct {
+	Entries map[string][]net.IP
+	Next    Resolver
+}
+
+// NewHosts 解析域名到IP列表的映射
+func NewHosts(entries map[string][]string, next Resolver) (*Hosts, error) {
+	hosts := &Hosts{Entries: make(map[string][]net.IP), Next: next}
+	for name, values := range entries {
+		for _, value := range values {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.Wrapf(&net.ParseError{Type: "IP address", Text: value}, "Invalid address of host[%s]", name)
+			}
+			key := normalizeName(name)
+			hosts.Entries[key] = append(hosts.Entries[key], ip)
+		}
+	}
+	return hosts, nil
+}
+
+func (r *Hosts) Resolve(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ips := literalIP(name); ips != nil {
+		return ips, 0, nil
+	}
+	if ips, exist := r.Entries[normalizeName(name)]; exist {
+		return ips, 0, nil
+	}
+	if r.Next == nil {
+		return nil, 0, notFoundError(name, "hosts")
+	}
+	return r.Next.Resolve(ctx, name)
+}
+
+func (r *Hosts) Watch(ctx context.Context) {
+	if r.Next != nil {
+		Watch(ctx, r.Next)
+	}
+}
+
+// Exchange 其他类型的查询不使用静态解析，直接交给Next
+func (r *Hosts) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if r.Next == nil {
+		return nil, errors.New("Resolver does not support forwarding queries")
+	}
+	return Exchange(ctx, r.Next, query)
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHosts(t *testing.T) {
+	stub := newStubResolver(map[string]*stubAnswer{
+		"db.internal":     {ips: []net.IP{net.ParseIP("198.51.100.9")}, ttl: time.Hour},
+		"www.example.com": {ips: []net.IP{net.ParseIP("198.51.100.10")}, ttl: time.Hour},
+	})
+	hosts, err := NewHosts(map[string][]string{
+		"DB.Internal.": {"10.0.0.20", "fd00::20"},
+	}, stub)
+	if err != nil {
+		t.Fatalf("NewHosts failed: %v", err)
+	}
+
+	for _, item := range []struct {
+		name  string
+		query string
+		ips   []string
+		calls int
+	}{
+		{name: "static entry overrides next", query: "db.internal", ips: []string{"10.0.0.20", "fd00::20"}},
+		{name: "case and trailing dot", query: "db.INTERNAL.", ips: []string{"10.0.0.20", "fd00::20"}},
+		{name: "fall through to next", query: "www.example.com", ips: []string{"198.51.100.10"}, calls: 1},
+		{name: "literal ip", query: "[2001:db8::1]", ips: []string{"2001:db8::1"}},
+	} {
+		ips, _, err := hosts.Resolve(context.Background(), item.query)
+		if err != nil {
+			t.Fatalf("%s: Resolve failed: %v", item.name, err)
+		}
+		if len(ips) != len(item.ips) {
+			t.Fatalf("%s: unexpected addresses %v, expect %v", item.name, ips, item.ips)
+		}
+		for i := range ips {
+			if !ips[i].Equal(net.ParseIP(item.ips[i])) {
+				t.Fatalf("%s: unexpected addresses %v, expect %v", item.name, ips, item.ips)
+			}
+		}
+		if calls := stub.count(normalizeName(item.query)); calls != item.calls {
+			t.Fatalf("%s: next resolver called %d times, expect %d", item.name, calls, item.calls)
+		}
+	}
+
+	if answer, err := hosts.Exchange(context.Background(), []byte("query")); err != nil || string(answer) != "answer:query" {
+		t.Fatalf("Exchange returned %q %v", answer, err)
+	}
+
+	standalone, err := NewHosts(map[string][]string{"db.internal": {"10.0.0.20"}}, nil)
+	if err != nil {
+		t.Fatalf("NewHosts failed: %v", err)
+	}
+	if _, _, err := standalone.Resolve(context.Background(), "www.example.com"); !IsNotFound(err) {
+		t.Fatalf("Resolve without next returned %v, expect not found", err)
+	}
+	if _, err := standalone.Exchange(context.Background(), []byte("query")); err == nil {
+		t.Fatalf("Exchange without next succeeded, expect error")
+	}
+	if _, err := NewHosts(map[string][]string{"db.internal": {"10.0.0.256"}}, nil); err == nil {
+		t.Fatalf("NewHosts with invalid address succeeded, expect error")
+	}
+}
+
+func TestSystemReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatalf("Create temp dir failed: %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	filePath := filepath.Join(dir, "resolv.conf")
+	system := &System{filePath: filePath}
+
+	for _, item := range []struct {
+		name    string
+		content string
+		reload  bool
+		servers []string
+		err     bool
+	}{
+		{name: "missing file", err: true},
+		{name: "first load", content: "# comment\nnameserver 192.0.2.53\nsearch example.com\n", reload: true, servers: []string{"192.0.2.53:53"}},
+		{name: "loaded once", content: "nameserver 192.0.2.54\n", servers: []string{"192.0.2.53:53"}},
+		{name: "reload", content: "nameserver 192.0.2.54\nnameserver 2001:db8::53\n", reload: true, servers: []string{"192.0.2.54:53", "[2001:db8::53]:53"}},
+		{name: "invalid file keeps servers", content: "search example.com\n", reload: true, servers: []string{"192.0.2.54:53", "[2001:db8::53]:53"}},
+	} {
+		if len(item.content) != 0 {
+			if err := ioutil.WriteFile(filePath, []byte(item.content), 0600); err != nil {
+				t.Fatalf("Write %s failed: %v", filePath, err)
+			}
+		}
+		if item.reload {
+			_ = system.Reload()
+		}
+		upstream, err := system.load()
+		if item.err {
+			if err == nil {
+				t.Fatalf("%s: load succeeded, expect error", item.name)
+			}
+			// 读取失败的结果同样只读取一次，之后由Reload重新加载
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: load failed: %v", item.name, err)
+		}
+		if len(upstream.Servers) != len(item.servers) {
+			t.Fatalf("%s: unexpected servers %v, expect %v", item.name, upstream.Servers, item.servers)
+		}
+		for i := range item.servers {
+			if upstream.Servers[i] != item.servers[i] {
+				t.Fatalf("%s: unexpected servers %v, expect %v", item.name, upstream.Servers, item.servers)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+	"github.com/liruonian/socks5/server/rule"
+)
+
+// handleReverseRequest 为socks5-local在服务端开放端口，回复之后该连接作为控制连接承载多路复用会话，
+// 每个入站连接由服务端在会话中打开一条逻辑连接，socks5-local断开时关闭端口
+// 会话不允许嵌套，多路复用会话中逻辑连接上的请求不予接受，socks5-local为控制连接单独建立连接
+func (s *server) handleReverseRequest(ctx context.Context, conn net.Conn, request *Request, policy *rule.Policy) error {
+	if fromMuxStream(ctx) {
+		if err := request.reply(conn, commandNotSupported, nil); err != nil {
+			return err
+		}
+		return errors.New("Reverse tunnel is not supported in a mux stream")
+	}
+
+	port := request.DestAddr.Port
+	if policy == nil || !policy.AllowReverse(port) {
+		if err := request.reply(conn, connectionNotAllowedByRuleset, nil); err != nil {
+			return err
+		}
+		return errors.Wrapf(notAllowedByRulesetError, "Reverse tunnel on port %d, user: %s", port, request.Identity.String())
+	}
+
+	listener, err := net.Listen(socks5.Tcp, net.JoinHostPort(s.config.GetReverseListenHost(), strconv.Itoa(port)))
+	if err != nil {
+		if err := request.reply(conn, generalSocksServerFailure, nil); err != nil {
+			return err
+		}
+		return err
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	bind := listener.Addr().(*net.TCPAddr)
+	if err := request.reply(conn, succeeded, &AddrSpec{IP: bind.IP, Port: bind.Port}); err != nil {
+		return err
+	}
+
+	session, err := proxy.NewMuxClient(proxy.NewBufferedConn(conn, request.reader), proxy.NewMuxConfig(0))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	// 控制连接断开或服务停止时关闭监听，已转发的连接随会话一起关闭
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-session.CloseChan():
+		}
+		_ = listener.Close()
+	}()
+
+	logrus.Infof("Reverse tunnel listening on %s for %s, user: %s", bind.String(), conn.RemoteAddr().String(), request.Identity.String())
+	for {
+		inbound, err := listener.Accept()
+		if err != nil {
+			if session.IsClosed() || ctx.Err() != nil {
+				logrus.Infof("Reverse tunnel on %s closed", bind.String())
+				return nil
+			}
+			logrus.Errorf("Error occured while accept tcp: %s", err.Error())
+			continue
+		}
+
+		go s.handleReverseConn(session, inbound)
+	}
+}
+
+// handleReverseConn 在会话中打开逻辑连接，先告知socks5-local入站连接的来源地址，再双向转发
+func (s *server) handleReverseConn(session *proxy.MuxSession, inbound net.Conn) {
+	defer func() {
+		_ = inbound.Close()
+	}()
+
+	stream, err := session.Open()
+	if err != nil {
+		logrus.Errorf("Error occoured while open reverse stream for %s: %s", inbound.RemoteAddr().String(), err.Error())
+		return
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	var source *AddrSpec
+	if remote, ok := inbound.RemoteAddr().(*net.TCPAddr); ok {
+		source = &AddrSpec{IP: remote.IP, Port: remote.Port}
+	}
+	header, err := encodeAddrSpec(source)
+	if err != nil {
+		logrus.Errorf("Error occoured while encode source address: %s", err.Error())
+		return
+	}
+	if _, err := stream.Write(header); err != nil {
+		logrus.Errorf("Error occoured while write reverse stream header: %s", err.Error())
+		return
+	}
+
+	errCh := make(chan error, 2)
+	go proxy.Proxy(stream, inbound, errCh)
+	go proxy.Proxy(inbound, stream, errCh)
+	for i := 0; i < 2; i++ {
+		if e := <-errCh; e != nil {
+			logrus.Errorf("Error occured: %s", e.Error())
+			return
+		}
+	}
+}
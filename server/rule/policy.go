@@ -0,0 +1,157 @@
+package rule
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5"
+)
+
+// 在Users中匹配所有用户，包括匿名用户
+const anyUser = "*"
+
+// Policy 针对用户或用户组的访问策略，在全局规则之外进一步限制该用户的请求
+type Policy struct {
+	// 策略适用的用户名以及用户组，满足其一即可
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// 允许使用的命令，可选connect、bind、associate、dns，为空表示不限制
+	Commands []string `json:"commands,omitempty"`
+
+	// 允许登录的客户端网段，为空表示不限制
+	Sources []string `json:"sources,omitempty"`
+
+	// 该用户的目的地址访问规则，以及没有规则匹配时的动作
+	Rules         []Rule `json:"rules,omitempty"`
+	DefaultAction string `json:"default_action,omitempty"`
+
+	// 允许通过反向隧道在服务端开放的端口，支持8000-9000形式的端口范围，为空表示不允许
+	ReversePorts []string `json:"reverse_ports,omitempty"`
+
+	commands     []uint8
+	sources      []*net.IPNet
+	ruleSet      *RuleSet
+	reversePorts []socks5.PortRange
+}
+
+// PolicySet 按顺序查找用户适用的策略，以第一条匹配的策略为准
+type PolicySet struct {
+	policies []*Policy
+}
+
+func NewPolicySet(policies []Policy) (*PolicySet, error) {
+	policySet := &PolicySet{}
+	for i := range policies {
+		policy := policies[i]
+		if err := policy.compile(); err != nil {
+			return nil, errors.Wrapf(err, "Invalid policy #%d", i+1)
+		}
+		policySet.policies = append(policySet.policies, &policy)
+	}
+	return policySet, nil
+}
+
+// Lookup 返回用户适用的策略，没有匹配的策略时返回nil，匿名用户的username为空
+func (p *PolicySet) Lookup(username string, groups []string) *Policy {
+	for _, policy := range p.policies {
+		if policy.matchUser(username, groups) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// AllowSource 判断用户是否可以从该客户端地址登录
+func (p *Policy) AllowSource(ip net.IP) bool {
+	return len(p.sources) == 0 || socks5.ContainsIP(p.sources, ip)
+}
+
+// Allow 判断用户是否可以使用该命令访问目的地址
+func (p *Policy) Allow(target *Target) bool {
+	return p.AllowCommand(target.Command) && p.ruleSet.Allow(target)
+}
+
+// AllowCommand 判断用户是否可以使用该命令
+func (p *Policy) AllowCommand(command uint8) bool {
+	if len(p.commands) == 0 {
+		return true
+	}
+	for _, item := range p.commands {
+		if item == command {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowAnswer 判断是否可以将DNS应答中的地址返回给该用户
+func (p *Policy) AllowAnswer(ip net.IP) bool {
+	return p.ruleSet.AllowAnswer(ip)
+}
+
+// AllowReverse 判断用户是否可以通过反向隧道在服务端开放该端口
+func (p *Policy) AllowReverse(port int) bool {
+	for _, item := range p.reversePorts {
+		if item.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) compile() error {
+	if len(p.Users) == 0 && len(p.Groups) == 0 {
+		return errors.New("Neither users nor groups specified")
+	}
+
+	for _, name := range p.Commands {
+		command, exist := commandNames[strings.ToLower(name)]
+		if !exist {
+			return errors.New(fmt.Sprintf("Unknown command: %s", name))
+		}
+		p.commands = append(p.commands, command)
+	}
+
+	for _, cidr := range p.Sources {
+		network, err := socks5.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		p.sources = append(p.sources, network)
+	}
+
+	for _, port := range p.ReversePorts {
+		portRange, err := socks5.ParsePortRange(port)
+		if err != nil {
+			return err
+		}
+		p.reversePorts = append(p.reversePorts, portRange)
+	}
+
+	ruleSet, err := NewRuleSet(p.Rules, p.DefaultAction)
+	if err != nil {
+		return err
+	}
+	p.ruleSet = ruleSet
+	return nil
+}
+
+func (p *Policy) matchUser(username string, groups []string) bool {
+	for _, user := range p.Users {
+		if user == anyUser || (len(username) != 0 && user == username) {
+			return true
+		}
+	}
+	for _, group := range p.Groups {
+		for _, item := range groups {
+			if group == item {
+				return true
+			}
+		}
+	}
+	return false
+}
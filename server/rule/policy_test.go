@@ -0,0 +1,118 @@
+package rule
+
+import (
+	"net"
+	"testing"
+
+	"github.com/liruonian/socks5/proxy"
+)
+
+func TestPolicyLookup(t *testing.T) {
+	policySet, err := NewPolicySet([]Policy{
+		{Users: []string{"alice"}, Commands: []string{"connect"}},
+		{Groups: []string{"dev", "ops"}, Sources: []string{"203.0.113.0/24", "2001:db8::/32"}},
+		{Users: []string{"*"}, Commands: []string{"dns"}},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicySet failed: %v", err)
+	}
+
+	for _, item := range []struct {
+		name     string
+		username string
+		groups   []string
+		policy   int
+	}{
+		{name: "username", username: "alice", groups: []string{"dev"}, policy: 0},
+		{name: "group", username: "bob", groups: []string{"guest", "ops"}, policy: 1},
+		{name: "any user", username: "carol", policy: 2},
+		{name: "anonymous", policy: 2},
+	} {
+		policy := policySet.Lookup(item.username, item.groups)
+		if policy == nil || policy != policySet.policies[item.policy] {
+			t.Fatalf("%s: Lookup(%s, %v) returned unexpected policy %+v, expect #%d", item.name, item.username, item.groups, policy, item.policy+1)
+		}
+	}
+
+	policySet, err = NewPolicySet([]Policy{{Users: []string{"alice"}}, {Groups: []string{"dev"}}})
+	if err != nil {
+		t.Fatalf("NewPolicySet failed: %v", err)
+	}
+	if policy := policySet.Lookup("", nil); policy != nil {
+		t.Fatalf("Lookup for anonymous user returned %+v, expect nil", policy)
+	}
+}
+
+func TestPolicyAllow(t *testing.T) {
+	policySet, err := NewPolicySet([]Policy{{
+		Users:         []string{"alice"},
+		Commands:      []string{"connect", "dns"},
+		Sources:       []string{"203.0.113.0/24", "2001:db8::/32"},
+		Rules:         []Rule{{Action: Allow, Ports: []string{"80", "443"}}, {Action: Deny, CIDRs: []string{"192.168.0.0/16"}}},
+		DefaultAction: Deny,
+		ReversePorts:  []string{"8080", "9000-9010"},
+	}})
+	if err != nil {
+		t.Fatalf("NewPolicySet failed: %v", err)
+	}
+	policy := policySet.Lookup("alice", nil)
+
+	for _, item := range []struct {
+		ip    string
+		allow bool
+	}{
+		{ip: "203.0.113.7", allow: true},
+		{ip: "::ffff:203.0.113.7", allow: true},
+		{ip: "2001:db8::7", allow: true},
+		{ip: "198.51.100.7", allow: false},
+	} {
+		if allow := policy.AllowSource(net.ParseIP(item.ip)); allow != item.allow {
+			t.Fatalf("AllowSource(%s) = %v, expect %v", item.ip, allow, item.allow)
+		}
+	}
+
+	for _, item := range []struct {
+		name   string
+		target Target
+		allow  bool
+	}{
+		{name: "allowed command and port", target: Target{Command: connect, FQDN: "example.com", Port: 443}, allow: true},
+		{name: "command not allowed", target: Target{Command: bind, FQDN: "example.com", Port: 443}, allow: false},
+		{name: "default action", target: Target{Command: connect, FQDN: "example.com", Port: 22}, allow: false},
+		{name: "first rule wins", target: Target{Command: connect, IP: net.ParseIP("192.168.1.1"), Port: 80}, allow: true},
+	} {
+		target := item.target
+		if allow := policy.Allow(&target); allow != item.allow {
+			t.Fatalf("%s: Allow(%+v) = %v, expect %v", item.name, item.target, allow, item.allow)
+		}
+	}
+
+	if !policy.AllowCommand(proxy.DNSCommand) || policy.AllowCommand(associate) {
+		t.Fatalf("Unexpected AllowCommand result for dns or associate")
+	}
+	if policy.AllowAnswer(net.ParseIP("192.168.1.1")) || !policy.AllowAnswer(net.ParseIP("8.8.8.8")) {
+		t.Fatalf("Unexpected AllowAnswer result")
+	}
+	for port, allow := range map[int]bool{8080: true, 9005: true, 9011: false, 22: false} {
+		if policy.AllowReverse(port) != allow {
+			t.Fatalf("AllowReverse(%d) = %v, expect %v", port, !allow, allow)
+		}
+	}
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	for _, item := range []struct {
+		name   string
+		policy Policy
+	}{
+		{name: "no users or groups", policy: Policy{Commands: []string{"connect"}}},
+		{name: "unknown command", policy: Policy{Users: []string{"alice"}, Commands: []string{"reverse"}}},
+		{name: "invalid source", policy: Policy{Users: []string{"alice"}, Sources: []string{"203.0.113.0/33"}}},
+		{name: "invalid reverse port", policy: Policy{Users: []string{"alice"}, ReversePorts: []string{"70000"}}},
+		{name: "invalid rule", policy: Policy{Users: []string{"alice"}, Rules: []Rule{{Action: "reject"}}}},
+	} {
+		if _, err := NewPolicySet([]Policy{item.policy}); err == nil {
+			t.Fatalf("%s: NewPolicySet succeeded, expect error", item.name)
+		}
+	}
+}
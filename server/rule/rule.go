@@ -0,0 +1,241 @@
+package rule
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+
+	regexpPrefix = "regexp:"
+)
+
+// 规则中可以使用的命令名称，与socks5协议中的命令编号一致
+var commandNames = map[string]uint8{
+	"connect":   1,
+	"bind":      2,
+	"associate": 3,
+	"dns":       proxy.DNSCommand,
+}
+
+// Rule 一条访问规则，各项条件之间为且的关系，同一项中的多个值之间为或的关系，未配置的条件视为匹配
+type Rule struct {
+	Action string `json:"action"`
+
+	// 目的地址所在的网段，匹配解析后的IP
+	CIDRs []string `json:"cidrs,omitempty"`
+
+	// 目的域名，example.com匹配该域名及其子域名，*.example.com为通配符，regexp:前缀表示正则表达式
+	Domains []string `json:"domains,omitempty"`
+
+	// 目的端口，支持单个端口以及8000-9000形式的端口范围
+	Ports []string `json:"ports,omitempty"`
+
+	// 请求命令，可选connect、bind、associate、dns
+	Commands []string `json:"commands,omitempty"`
+
+	networks []*net.IPNet
+	suffixes []string
+	patterns []*regexp.Regexp
+	ports    []socks5.PortRange
+	commands []uint8
+}
+
+// Target 需要进行规则匹配的请求，FQDN为空表示客户端直接请求IP地址
+type Target struct {
+	Command uint8
+	FQDN    string
+	IP      net.IP
+	Port    int
+}
+
+// RuleSet 按顺序匹配规则，以第一条匹配的规则为准，都不匹配时采用默认动作
+type RuleSet struct {
+	rules        []*Rule
+	defaultAllow bool
+}
+
+// DefaultRules 禁止访问本机、链路本地以及内网地址，防止通过代理访问内部网络
+func DefaultRules() []Rule {
+	return []Rule{
+		{
+			Action: Deny,
+			CIDRs: []string{
+				"0.0.0.0/8",
+				"127.0.0.0/8",
+				"169.254.0.0/16",
+				"10.0.0.0/8",
+				"172.16.0.0/12",
+				"192.168.0.0/16",
+				"::/128",
+				"::1/128",
+				"fe80::/10",
+				"fc00::/7",
+			},
+		},
+	}
+}
+
+func NewRuleSet(rules []Rule, defaultAction string) (*RuleSet, error) {
+	ruleSet := &RuleSet{defaultAllow: true}
+	switch defaultAction {
+	case "", Allow:
+	case Deny:
+		ruleSet.defaultAllow = false
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown default action: %s", defaultAction))
+	}
+
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.compile(); err != nil {
+			return nil, errors.Wrapf(err, "Invalid rule #%d", i+1)
+		}
+		ruleSet.rules = append(ruleSet.rules, &rule)
+	}
+	return ruleSet, nil
+}
+
+func (r *RuleSet) Allow(target *Target) bool {
+	for _, rule := range r.rules {
+		if rule.match(target) {
+			return rule.Action == Allow
+		}
+	}
+	return r.defaultAllow
+}
+
+// AllowAnswer 判断DNS应答中的地址是否可以返回给客户端，只有配置了网段、没有端口条件并且适用于dns命令的规则参与匹配，
+// 都不匹配时不过滤
+func (r *RuleSet) AllowAnswer(ip net.IP) bool {
+	for _, rule := range r.rules {
+		if len(rule.networks) == 0 || len(rule.ports) != 0 || !rule.matchCommand(proxy.DNSCommand) {
+			continue
+		}
+		if socks5.ContainsIP(rule.networks, ip) {
+			return rule.Action == Allow
+		}
+	}
+	return true
+}
+
+func (r *Rule) compile() error {
+	if r.Action != Allow && r.Action != Deny {
+		return errors.New(fmt.Sprintf("Unknown action: %s", r.Action))
+	}
+
+	for _, cidr := range r.CIDRs {
+		network, err := socks5.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		r.networks = append(r.networks, network)
+	}
+
+	for _, domain := range r.Domains {
+		switch {
+		case strings.HasPrefix(domain, regexpPrefix):
+			pattern, err := regexp.Compile("(?i)" + strings.TrimPrefix(domain, regexpPrefix))
+			if err != nil {
+				return err
+			}
+			r.patterns = append(r.patterns, pattern)
+		case strings.Contains(domain, "*"):
+			quoted := regexp.QuoteMeta(normalizeDomain(domain))
+			pattern := regexp.MustCompile("(?i)^" + strings.ReplaceAll(quoted, `\*`, ".*") + "$")
+			r.patterns = append(r.patterns, pattern)
+		default:
+			r.suffixes = append(r.suffixes, normalizeDomain(domain))
+		}
+	}
+
+	for _, port := range r.Ports {
+		portRange, err := socks5.ParsePortRange(port)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, portRange)
+	}
+
+	for _, name := range r.Commands {
+		command, exist := commandNames[strings.ToLower(name)]
+		if !exist {
+			return errors.New(fmt.Sprintf("Unknown command: %s", name))
+		}
+		r.commands = append(r.commands, command)
+	}
+	return nil
+}
+
+func (r *Rule) match(target *Target) bool {
+	return r.matchCommand(target.Command) &&
+		r.matchPort(target.Port) &&
+		r.matchAddress(target)
+}
+
+func (r *Rule) matchCommand(command uint8) bool {
+	if len(r.commands) == 0 {
+		return true
+	}
+	for _, item := range r.commands {
+		if item == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, item := range r.ports {
+		if item.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress 同时配置了网段和域名时，满足其中之一即可
+func (r *Rule) matchAddress(target *Target) bool {
+	if len(r.networks) == 0 && len(r.suffixes) == 0 && len(r.patterns) == 0 {
+		return true
+	}
+
+	if len(target.IP) != 0 {
+		for _, network := range r.networks {
+			if network.Contains(target.IP) {
+				return true
+			}
+		}
+	}
+
+	if len(target.FQDN) != 0 {
+		domain := normalizeDomain(target.FQDN)
+		for _, suffix := range r.suffixes {
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		}
+		for _, pattern := range r.patterns {
+			if pattern.MatchString(domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
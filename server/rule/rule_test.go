@@ -0,0 +1,142 @@
+package rule
+
+import (
+	"net"
+	"testing"
+
+	"github.com/liruonian/socks5/proxy"
+)
+
+const (
+	connect   = uint8(1)
+	bind      = uint8(2)
+	associate = uint8(3)
+)
+
+func newRuleSet(t *testing.T, rules []Rule, defaultAction string) *RuleSet {
+	ruleSet, err := NewRuleSet(rules, defaultAction)
+	if err != nil {
+		t.Fatalf("NewRuleSet failed: %v", err)
+	}
+	return ruleSet
+}
+
+func TestRuleSetFirstMatch(t *testing.T) {
+	ruleSet := newRuleSet(t, []Rule{
+		{Action: Allow, Domains: []string{"intranet.example.com"}, Ports: []string{"443", "8000-9000"}},
+		{Action: Deny, Domains: []string{"example.com"}},
+		{Action: Deny, Domains: []string{"*.internal", "regexp:^db[0-9]+\\."}},
+		{Action: Deny, CIDRs: []string{"10.0.0.0/8", "fd00::/8"}, Commands: []string{"connect", "bind"}},
+		{Action: Allow, CIDRs: []string{"192.0.2.0/24"}},
+		{Action: Deny, Ports: []string{"25"}},
+	}, Deny)
+
+	for _, item := range []struct {
+		name   string
+		target Target
+		allow  bool
+	}{
+		{name: "earlier allow wins over later deny", target: Target{Command: connect, FQDN: "intranet.example.com", Port: 443}, allow: true},
+		{name: "port range", target: Target{Command: connect, FQDN: "api.intranet.example.com", Port: 8080}, allow: true},
+		{name: "port outside range falls through", target: Target{Command: connect, FQDN: "intranet.example.com", Port: 80}, allow: false},
+		{name: "domain suffix", target: Target{Command: connect, FQDN: "www.example.com.", Port: 443}, allow: false},
+		{name: "suffix is not a substring", target: Target{Command: connect, FQDN: "notexample.com", Port: 443}, allow: false},
+		{name: "wildcard", target: Target{Command: connect, FQDN: "Git.Internal", Port: 22}, allow: false},
+		{name: "regexp", target: Target{Command: connect, FQDN: "db12.example.org", Port: 5432}, allow: false},
+		{name: "cidr with command", target: Target{Command: bind, IP: net.ParseIP("10.1.2.3"), Port: 80}, allow: false},
+		{name: "cidr for other command falls through", target: Target{Command: associate, IP: net.ParseIP("10.1.2.3"), Port: 80}, allow: false},
+		{name: "ipv6 cidr", target: Target{Command: connect, IP: net.ParseIP("fd00::1"), Port: 80}, allow: false},
+		{name: "allow cidr", target: Target{Command: associate, IP: net.ParseIP("192.0.2.10"), Port: 53}, allow: true},
+		{name: "allow before port deny", target: Target{Command: connect, IP: net.ParseIP("192.0.2.10"), Port: 25}, allow: true},
+		{name: "port deny", target: Target{Command: connect, IP: net.ParseIP("198.51.100.1"), Port: 25}, allow: false},
+		{name: "default action", target: Target{Command: connect, IP: net.ParseIP("198.51.100.1"), Port: 80}, allow: false},
+	} {
+		target := item.target
+		if allow := ruleSet.Allow(&target); allow != item.allow {
+			t.Fatalf("%s: Allow(%+v) = %v, expect %v", item.name, item.target, allow, item.allow)
+		}
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	ruleSet := newRuleSet(t, DefaultRules(), "")
+
+	for _, item := range []struct {
+		ip    string
+		allow bool
+	}{
+		{ip: "127.0.0.1", allow: false},
+		{ip: "0.0.0.0", allow: false},
+		{ip: "10.20.30.40", allow: false},
+		{ip: "172.16.0.1", allow: false},
+		{ip: "172.31.255.255", allow: false},
+		{ip: "192.168.1.1", allow: false},
+		{ip: "169.254.169.254", allow: false},
+		{ip: "::1", allow: false},
+		{ip: "::", allow: false},
+		{ip: "fe80::1", allow: false},
+		{ip: "fd12:3456::1", allow: false},
+		{ip: "::ffff:127.0.0.1", allow: false},
+		{ip: "::ffff:169.254.169.254", allow: false},
+		{ip: "::ffff:10.0.0.1", allow: false},
+		{ip: "172.32.0.1", allow: true},
+		{ip: "8.8.8.8", allow: true},
+		{ip: "::ffff:8.8.8.8", allow: true},
+		{ip: "2001:4860:4860::8888", allow: true},
+	} {
+		for _, command := range []uint8{connect, bind, associate, proxy.DNSCommand} {
+			target := &Target{Command: command, IP: net.ParseIP(item.ip), Port: 80}
+			if allow := ruleSet.Allow(target); allow != item.allow {
+				t.Fatalf("Allow(%s, command %d) = %v, expect %v", item.ip, command, allow, item.allow)
+			}
+		}
+		if allow := ruleSet.AllowAnswer(net.ParseIP(item.ip)); allow != item.allow {
+			t.Fatalf("AllowAnswer(%s) = %v, expect %v", item.ip, allow, item.allow)
+		}
+	}
+}
+
+func TestAllowAnswer(t *testing.T) {
+	ruleSet := newRuleSet(t, []Rule{
+		{Action: Deny, CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"22"}},
+		{Action: Deny, CIDRs: []string{"172.16.0.0/12"}, Commands: []string{"connect"}},
+		{Action: Deny, Domains: []string{"example.com"}},
+		{Action: Allow, CIDRs: []string{"192.168.1.0/24"}, Commands: []string{"dns"}},
+		{Action: Deny, CIDRs: []string{"192.168.0.0/16"}},
+	}, Deny)
+
+	for _, item := range []struct {
+		ip    string
+		allow bool
+	}{
+		{ip: "10.0.0.1", allow: true},
+		{ip: "172.16.0.1", allow: true},
+		{ip: "192.168.1.1", allow: true},
+		{ip: "192.168.2.1", allow: false},
+		{ip: "::ffff:192.168.2.1", allow: false},
+		{ip: "8.8.8.8", allow: true},
+	} {
+		if allow := ruleSet.AllowAnswer(net.ParseIP(item.ip)); allow != item.allow {
+			t.Fatalf("AllowAnswer(%s) = %v, expect %v", item.ip, allow, item.allow)
+		}
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, item := range []struct {
+		name          string
+		rules         []Rule
+		defaultAction string
+	}{
+		{name: "unknown action", rules: []Rule{{Action: "reject"}}},
+		{name: "unknown default action", defaultAction: "reject"},
+		{name: "invalid cidr", rules: []Rule{{Action: Deny, CIDRs: []string{"10.0.0.0/33"}}}},
+		{name: "invalid regexp", rules: []Rule{{Action: Deny, Domains: []string{"regexp:("}}}},
+		{name: "invalid port range", rules: []Rule{{Action: Deny, Ports: []string{"9000-8000"}}}},
+		{name: "unknown command", rules: []Rule{{Action: Deny, Commands: []string{"reverse"}}}},
+	} {
+		if _, err := NewRuleSet(item.rules, item.defaultAction); err == nil {
+			t.Fatalf("%s: NewRuleSet succeeded, expect error", item.name)
+		}
+	}
+}
@@ -3,18 +3,23 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/liruonian/socks5/server/auth"
+	"github.com/liruonian/socks5/server/resolver"
+	"github.com/liruonian/socks5/server/rule"
 
 	"github.com/liruonian/socks5/proxy"
 
@@ -25,12 +30,27 @@ import (
 
 var (
 	addressTypeNotSupportedError = errors.New("Address type not supported")
+	notAllowedByRulesetError     = errors.New("Not allowed by ruleset")
+)
+
+const (
+	usersReloadInterval   = 5 * time.Second
+	clientsReloadInterval = 5 * time.Second
+	bansReloadInterval    = 5 * time.Second
 )
 
 type server struct {
 	config               *Config
 	listener             net.Listener
 	supportedAuthMethods map[uint8]auth.Authenticator
+	authMethods          []uint8
+	httpTransport        *http.Transport
+	ruleSet              *rule.RuleSet
+	policySet            *rule.PolicySet
+	clientFilter         *clientFilter
+	tlsConfig            *tls.Config
+	cipher               *proxy.Cipher
+	resolver             resolver.Resolver
 }
 
 var singleton *server
@@ -41,12 +61,12 @@ func InitServer(config *Config) {
 		// 将server初始化为单例
 		singleton = &server{config: config}
 
-		// 基于配置，判断当前server端支持的socks5的认证模式
+		// 默认支持无认证模式，其他认证方式根据配置或由调用方注册
 		singleton.supportedAuthMethods = make(map[uint8]auth.Authenticator)
-		singleton.supportedAuthMethods[auth.NoAuthenticationMethod] = &auth.NoAuthenticator{}
-		if len(config.Username) != 0 && len(config.Password) != 0 {
-			singleton.supportedAuthMethods[auth.UsernamePasswordAuthenticationMethod] = &auth.UsernamePasswordAuthenticator{}
-		}
+		singleton.RegisterAuthenticator(&auth.NoAuthenticator{})
+
+		// HTTP正向代理复用到目标服务器的连接
+		singleton.httpTransport = singleton.newHTTPTransport()
 
 		// 记录当前进程的pid，当执行stop命令时，向该pid发送sigterm信号
 		_ = socks5.RecordPid(socks5.ServerSidePidPath)
@@ -60,6 +80,16 @@ func GetServer() *server {
 	return singleton
 }
 
+// RegisterAuthenticator 按照认证方式的编号注册authenticator，已存在的同编号authenticator将被替换
+func (s *server) RegisterAuthenticator(authenticator auth.Authenticator) {
+	s.supportedAuthMethods[authenticator.GetMethod()] = authenticator
+}
+
+// SetResolver 使用自定义的解析器解析目的域名，替代配置中的解析器，需要在StartServer之前调用
+func (s *server) SetResolver(r resolver.Resolver) {
+	s.resolver = r
+}
+
 func (s *server) StartServer() {
 	// 校验配置文件的参数，是否存在不合理的配置
 	err := s.config.Precheck()
@@ -74,10 +104,144 @@ func (s *server) StartServer() {
 	ctx, cancel := context.WithCancel(context.Background())
 	go s.waitingSignal(channel, cancel)
 
+	// 加载目的地址访问规则以及用户访问策略
+	s.ruleSet, err = s.config.NewRuleSet()
+	if err != nil {
+		logrus.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+	s.policySet, err = rule.NewPolicySet(s.config.UserPolicies)
+	if err != nil {
+		logrus.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+
+	// 未指定自定义解析器时，按照配置创建带缓存的解析器，依赖的resolv.conf等文件发生变化时自动重新加载
+	if s.resolver == nil {
+		s.resolver, err = s.config.NewResolver()
+		if err != nil {
+			logrus.Errorf("Invalid configuration: %s", err.Error())
+			return
+		}
+	}
+	resolver.Watch(ctx, s.resolver)
+
+	// 加载客户端地址的允许以及拒绝名单
+	s.clientFilter, err = newClientFilter(s.config)
+	if err != nil {
+		logrus.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+	s.clientFilter.watch(ctx)
+
+	// 配置了TLS证书或预共享密钥时，所有连接在握手之前先解密
+	if err := s.initTransport(); err != nil {
+		logrus.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+
+	// 基于配置，判断当前server端支持的socks5的认证模式
+	if err := s.initAuthMethods(ctx); err != nil {
+		logrus.Errorf("Error occured while init authentication: %s", err.Error())
+		return
+	}
+
 	// 开始监听连接到代理服务器的流量
 	s.listen(ctx)
 }
 
+func (s *server) initAuthMethods(ctx context.Context) error {
+	// 优先使用用户文件，文件发生变化时自动重新加载
+	var store auth.UserStore
+	if len(s.config.UsersFile) != 0 {
+		fileStore, err := auth.NewFileUserStore(s.config.UsersFile)
+		if err != nil {
+			return err
+		}
+		go socks5.WatchFile(ctx, s.config.UsersFile, usersReloadInterval, func() {
+			if err := fileStore.Reload(); err != nil {
+				logrus.Errorf("Error occured while reload users: %s", err.Error())
+				return
+			}
+			logrus.Infof("Users reloaded from %s", s.config.UsersFile)
+		})
+		store = fileStore
+	} else if len(s.config.Username) != 0 && len(s.config.Password) != 0 {
+		store = &auth.StaticUserStore{Username: s.config.Username, Password: s.config.Password}
+	}
+
+	if store != nil {
+		authenticator := &auth.UsernamePasswordAuthenticator{Store: store}
+		if threshold := s.config.GetMaxAuthFailures(); threshold > 0 {
+			lockout, err := auth.NewLockout(threshold, s.config.GetAuthBanDuration(), s.config.GetBansFile())
+			if err != nil {
+				return err
+			}
+			// 通过命令行解除封禁后，重新加载封禁记录
+			go socks5.WatchFile(ctx, s.config.GetBansFile(), bansReloadInterval, func() {
+				if err := lockout.Reload(); err != nil {
+					logrus.Errorf("Error occured while reload bans: %s", err.Error())
+				}
+			})
+			authenticator.Lockout = lockout
+		}
+		s.RegisterAuthenticator(authenticator)
+	}
+
+	// 配置keytab后支持基于Kerberos的GSSAPI认证
+	if len(s.config.GSSAPIKeytab) != 0 {
+		mechanism, err := auth.NewKerberosMechanism(s.config.GSSAPIKeytab, s.config.GSSAPIServicePrincipal)
+		if err != nil {
+			return err
+		}
+		s.RegisterAuthenticator(&auth.GSSAPIAuthenticator{Mechanism: mechanism})
+	}
+
+	// 未指定认证方式时，配置了凭据的认证方式优先且必须使用，否则允许无认证访问
+	s.authMethods = nil
+	if len(s.config.AuthMethods) == 0 {
+		for _, method := range []uint8{auth.GSSAPIAuthenticationMethod, auth.UsernamePasswordAuthenticationMethod} {
+			if _, exist := s.supportedAuthMethods[method]; exist {
+				s.authMethods = append(s.authMethods, method)
+			}
+		}
+		if len(s.authMethods) == 0 {
+			s.authMethods = []uint8{auth.NoAuthenticationMethod}
+		}
+		return nil
+	}
+	for _, name := range s.config.AuthMethods {
+		method, _ := auth.ParseMethod(name)
+		if _, exist := s.supportedAuthMethods[method]; !exist {
+			return errors.New(fmt.Sprintf("Authentication method %s is not configured", name))
+		}
+		s.authMethods = append(s.authMethods, method)
+	}
+	return nil
+}
+
+// selectAuthenticator 按照服务端配置的优先级，返回第一个客户端同样支持的认证方式
+func (s *server) selectAuthenticator(offered []byte) auth.Authenticator {
+	for _, method := range s.authMethods {
+		for _, item := range offered {
+			if item == method {
+				return s.supportedAuthMethods[method]
+			}
+		}
+	}
+	return nil
+}
+
+// authMethodAllowed 判断认证方式是否在服务端接受的范围内
+func (s *server) authMethodAllowed(method uint8) bool {
+	for _, item := range s.authMethods {
+		if item == method {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *server) waitingSignal(channel chan os.Signal, cancel context.CancelFunc) {
 	<-channel
 	cancel()
@@ -107,62 +271,105 @@ func (s *server) listen(ctx context.Context) {
 				continue
 			}
 
-			go s.handle(conn)
+			// 在读取任何数据之前过滤客户端地址
+			if !s.clientFilter.accept(conn.RemoteAddr()) {
+				rejected := s.clientFilter.reject()
+				logrus.Warnf("Reject connection from %s, total rejected: %d", conn.RemoteAddr().String(), rejected)
+				_ = conn.Close()
+				continue
+			}
+
+			go s.handle(ctx, conn)
 		}
 	}
 }
 
-func (s *server) handle(conn net.Conn) {
+func (s *server) handle(ctx context.Context, conn net.Conn) {
 	defer func() {
 		_ = conn.Close()
 	}()
+	ctx, wrapped, err := s.wrapConn(ctx, conn)
+	if err == io.EOF {
+		// 健康检查等探测连接建立后立即关闭，不视为错误
+		logrus.Debugf("Connection from %s closed before handshake", conn.RemoteAddr().String())
+		return
+	} else if err != nil {
+		logrus.Errorf("Error occoured while setup transport from %s: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	conn = wrapped
+	if client := clientAddrSpec(conn); client != nil {
+		ctx = auth.WithClientIP(ctx, client.IP)
+	}
+
+	s.serveTunnel(ctx, conn)
+}
+
+// serve 根据第一个字节区分协议，多路复用会话以及WebSocket隧道中的连接同样由serve处理
+// 会话中的每条逻辑连接不允许再嵌套会话或隧道
+func (s *server) serve(ctx context.Context, conn net.Conn, allowTunnel bool) {
 	reader := bufio.NewReader(conn)
 
-	// 协商socks版本
-	version := []byte{0}
-	if _, err := reader.Read(version); err != nil {
+	// 协商socks版本，HTTP请求以大写的方法名开头，交由HTTP代理处理
+	version, err := reader.Peek(1)
+	if err == io.EOF {
+		logrus.Debugf("Connection from %s closed before any data", conn.RemoteAddr().String())
+		return
+	} else if err != nil {
 		logrus.Errorf("Error occoured while get version byte: %s", err.Error())
 		return
 	}
-	if version[0] != socks5Version {
+	switch {
+	case version[0] == proxy.MuxVersion && allowTunnel:
+		s.handleMux(ctx, proxy.NewBufferedConn(conn, reader))
+		return
+	case version[0] >= 'A' && version[0] <= 'Z':
+		s.handleHTTP(ctx, reader, conn, allowTunnel)
+		return
+	case version[0] == socks4Version:
+		_, _ = reader.Discard(1)
+		s.handleSocks4(ctx, reader, conn)
+		return
+	case version[0] != socks5Version:
 		logrus.Errorf("Unsupported socks version, expect %v, get %v", socks5Version, version[0])
 		return
 	}
+	_, _ = reader.Discard(1)
 
-	// 协商认证机制，如果未匹配到合适的认证方式，则采用无认证模式
+	// 协商认证机制，按照服务端的优先级选择客户端支持的认证方式
 	nmethods := []byte{0}
 	if _, err := reader.Read(nmethods); err != nil {
 		logrus.Errorf("Error occoured while get method number bytes: %s", err.Error())
 		return
 	}
 	methods := make([]byte, nmethods[0])
-	_, err := io.ReadAtLeast(reader, methods, int(nmethods[0]))
+	_, err = io.ReadAtLeast(reader, methods, int(nmethods[0]))
 	if err != nil {
 		logrus.Errorf("Error occoured while get method bytes: %s", err.Error())
 		return
 	}
-	var authenticator auth.Authenticator
-	for _, method := range methods {
-		if item, exist := s.supportedAuthMethods[method]; exist {
-			authenticator = item
-		}
-	}
+	authenticator := s.selectAuthenticator(methods)
 	if authenticator == nil {
-		authenticator = s.supportedAuthMethods[auth.NoAuthenticationMethod]
+		logrus.Errorf("No acceptable authentication method from %s, offered: %v", conn.RemoteAddr().String(), methods)
+		_, _ = conn.Write([]byte{socks5Version, noAcceptableMethods})
+		return
 	}
-	switch authenticator.GetMethod() {
-	case auth.NoAuthenticationMethod:
-		err := s.noAuthNegotiation(authenticator, conn)
-		if err != nil {
-			logrus.Errorf("Error occoured while initial socks connection setup: %s", err.Error())
-			return
-		}
-	case auth.UsernamePasswordAuthenticationMethod:
-		err := s.usernamePasswordNegotiation(authenticator, reader, conn)
-		if err != nil {
-			logrus.Errorf("Error occoured while initial socks connection setup: %s", err.Error())
-			return
-		}
+
+	// 告知客户端选定的认证方式，随后由authenticator完成子协商
+	if _, err := conn.Write([]byte{socks5Version, authenticator.GetMethod()}); err != nil {
+		logrus.Errorf("Error occoured while initial socks connection setup: %s", err.Error())
+		return
+	}
+	identity, err := authenticator.Authenticate(ctx, reader, conn)
+	if err != nil {
+		logrus.Errorf("Error occoured while initial socks connection setup: %s", err.Error())
+		return
+	}
+
+	// 认证方式要求封装后续数据时，之后的请求和转发都经过封装后的连接
+	if identity.Encapsulator != nil {
+		conn = identity.Encapsulator.Encapsulate(proxy.NewBufferedConn(conn, reader))
+		reader = bufio.NewReader(conn)
 	}
 
 	// 解析本次请求类型
@@ -179,74 +386,17 @@ func (s *server) handle(conn net.Conn) {
 	if request == nil {
 		return
 	}
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
-	}
+	request.RemoteAddr = clientAddrSpec(conn)
+	request.Identity = identity
 
 	// 处理请求
-	if err := s.handleRequest(request, conn); err != nil {
+	if err := s.handleRequest(ctx, request, conn); err != nil {
 		logrus.Errorf("Error occoured while handle request: %s", err.Error())
 		return
 	}
 
 }
 
-func (s *server) usernamePasswordNegotiation(authenticator auth.Authenticator, reader *bufio.Reader, writer io.Writer) error {
-	// 首先告知客户端，采用USERNAME/PASSWORD的方式进行认证
-	_, err := writer.Write([]byte{socks5Version, authenticator.GetMethod()})
-	if err != nil {
-		return err
-	}
-
-	// 读取header部分，包含VER & ULEN，参考RFC 1929
-	header := []byte{0, 0}
-	if _, err := io.ReadAtLeast(reader, header, 2); err != nil {
-		return err
-	}
-
-	// 确认认证协议的版本一致
-	if header[0] != authVersion {
-		return errors.New(fmt.Sprintf("Unsupported auth version, expect %v, get %v", authVersion, header[0]))
-	}
-
-	// 读取用户名
-	ulen := int(header[1])
-	username := make([]byte, ulen)
-	if _, err := io.ReadAtLeast(reader, username, ulen); err != nil {
-		return err
-	}
-
-	// 读取密码，复用header字节数组
-	if _, err := reader.Read(header[:1]); err != nil {
-		return err
-	}
-	plen := int(header[0])
-	password := make([]byte, plen)
-	if _, err := io.ReadAtLeast(reader, password, plen); err != nil {
-		return err
-	}
-
-	// 校验认证结果，并写回给客户端
-	err = authenticator.Authenticate(auth.Authentication{
-		Principle:   string(username),
-		Credentials: string(password),
-	}, auth.Authentication{
-		Principle:   s.config.Username,
-		Credentials: s.config.Password,
-	})
-	if err != nil {
-		_, err := writer.Write([]byte{authVersion, authFailure})
-		return err
-	}
-	_, err = writer.Write([]byte{authVersion, authSuccess})
-	return err
-}
-
-func (s *server) noAuthNegotiation(authenticator auth.Authenticator, writer io.Writer) error {
-	_, err := writer.Write([]byte{socks5Version, authenticator.GetMethod()})
-	return err
-}
-
 func (s *server) newRequest(reader *bufio.Reader) (*Request, error) {
 	header := []byte{0, 0, 0}
 	if _, err := io.ReadAtLeast(reader, header, 3); err != nil {
@@ -259,103 +409,102 @@ func (s *server) newRequest(reader *bufio.Reader) (*Request, error) {
 	}
 
 	// 根据不同的地址类型，读取目的地址信息
-	dest := &AddrSpec{}
-	atyp := []byte{0}
-	if _, err := reader.Read(atyp); err != nil {
-		return nil, err
-	}
-	switch atyp[0] {
-	case ipv4Address:
-		addr := make([]byte, 4)
-		if _, err := io.ReadAtLeast(reader, addr, len(addr)); err != nil {
-			return nil, err
-		}
-		dest.IP = net.IP(addr)
-	case ipv6Address:
-		addr := make([]byte, 16)
-		if _, err := io.ReadAtLeast(reader, addr, len(addr)); err != nil {
-			return nil, err
-		}
-		dest.IP = net.IP(addr)
-	case fqdnAddress:
-		if _, err := reader.Read(atyp); err != nil {
-			return nil, err
-		}
-		addrLen := int(atyp[0])
-		fqdn := make([]byte, addrLen)
-		if _, err := io.ReadAtLeast(reader, fqdn, addrLen); err != nil {
-			return nil, err
-		}
-		dest.FQDN = string(fqdn)
-	default:
-		return nil, addressTypeNotSupportedError
-	}
-
-	// 获取端口信息
-	port := []byte{0, 0}
-	if _, err := io.ReadAtLeast(reader, port, 2); err != nil {
+	dest, err := readAddrSpec(reader)
+	if err != nil {
 		return nil, err
 	}
-	dest.Port = (int(port[0]) << 8) | int(port[1])
 
 	return &Request{
-		Version:  socks5Version,
-		Command:  header[1],
-		DestAddr: dest,
-		reader:   reader,
+		Version:   socks5Version,
+		Command:   header[1],
+		DestAddr:  dest,
+		reader:    reader,
+		replyFunc: sendReply,
 	}, nil
 }
 
-func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
-	var addrType uint8
-	var addrBody []byte
-	var addrPort uint16
-	switch {
-	case addr == nil:
-		addrType = ipv4Address
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
-
-	case addr.FQDN != "":
-		addrType = fqdnAddress
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
-
-	case addr.IP.To4() != nil:
-		addrType = ipv4Address
-		addrBody = []byte(addr.IP.To4())
-		addrPort = uint16(addr.Port)
-
-	case addr.IP.To16() != nil:
-		addrType = ipv6Address
-		addrBody = []byte(addr.IP.To16())
-		addrPort = uint16(addr.Port)
+// tunnelKey 标记经多路复用会话或WebSocket隧道到达的请求，此时连接的对端是隧道的另一端而不是实际的应用
+type tunnelKey struct{}
 
-	default:
-		return errors.New(fmt.Sprintf("Failed to format address: %v", addr))
+// withTunnel 隧道中的请求共享同一个对端地址，认证失败只按用户名计数，以免一个用户的失败封禁隧道中的所有用户
+func withTunnel(ctx context.Context) context.Context {
+	return auth.WithClientIP(context.WithValue(ctx, tunnelKey{}, true), nil)
+}
+
+func fromTunnel(ctx context.Context) bool {
+	tunnel, _ := ctx.Value(tunnelKey{}).(bool)
+	return tunnel
+}
+
+// muxStreamKey 标记多路复用会话中逻辑连接上的请求
+type muxStreamKey struct{}
+
+func withMuxStream(ctx context.Context) context.Context {
+	return context.WithValue(ctx, muxStreamKey{}, true)
+}
+
+func fromMuxStream(ctx context.Context) bool {
+	stream, _ := ctx.Value(muxStreamKey{}).(bool)
+	return stream
+}
+
+func clientAddrSpec(conn net.Conn) *AddrSpec {
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return &AddrSpec{IP: client.IP, Port: client.Port}
 	}
+	return nil
+}
 
-	msg := make([]byte, 6+len(addrBody))
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	addrBytes, err := encodeAddrSpec(addr)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 3+len(addrBytes))
 	msg[0] = socks5Version
 	msg[1] = resp
 	msg[2] = 0
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	copy(msg[3:], addrBytes)
 
-	_, err := w.Write(msg)
+	_, err = w.Write(msg)
 	return err
 }
 
-func (s *server) handleRequest(request *Request, conn net.Conn) error {
-	ctx := context.Background()
-
+func (s *server) handleRequest(ctx context.Context, request *Request, conn net.Conn) error {
 	dest := request.DestAddr
+	logrus.Infof("Request command %v from %s to %s, user: %s", request.Command, conn.RemoteAddr().String(), dest.Address(), request.Identity.String())
+
+	// 用户只能从策略允许的客户端地址登录
+	policy := s.lookupPolicy(request.Identity)
+	if !s.sourceAllowed(policy, request.RemoteAddr) {
+		if err := request.reply(conn, connectionNotAllowedByRuleset, nil); err != nil {
+			return err
+		}
+		return errors.Wrapf(notAllowedByRulesetError, "User %s from %s", request.Identity.String(), conn.RemoteAddr().String())
+	}
+
+	// 反向隧道的目的地址是服务端开放的端口，由用户策略授权，DNS查询没有目的地址，按访问规则过滤应答，都不经过目的地址访问规则
+	// UDP ASSOCIATE的DST是客户端发送报文的地址提示，通常为0.0.0.0:0，只校验命令，每个报文的目的地址在转发时校验
+	switch request.Command {
+	case proxy.ReverseCommand:
+		return s.handleReverseRequest(ctx, conn, request, policy)
+	case proxy.DNSCommand:
+		return s.handleDNSRequest(ctx, conn, request, policy)
+	case AssociateCommand:
+		if policy != nil && !policy.AllowCommand(AssociateCommand) {
+			if err := request.reply(conn, connectionNotAllowedByRuleset, nil); err != nil {
+				return err
+			}
+			return errors.Wrapf(notAllowedByRulesetError, "Udp associate of user %s", request.Identity.String())
+		}
+		return s.handleAssociateRequest(ctx, conn, request, policy)
+	}
+
 	if dest.FQDN != "" {
 		ctx_, addr, err := s.resolve(ctx, dest.FQDN)
 		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			if err := request.reply(conn, hostUnreachable, nil); err != nil {
 				return err
 			}
 			return err
@@ -364,11 +513,21 @@ func (s *server) handleRequest(request *Request, conn net.Conn) error {
 		dest.IP = addr
 	}
 
+	// 在建立连接之前校验访问规则
+	if !s.allowed(policy, request.Command, dest) {
+		if err := request.reply(conn, connectionNotAllowedByRuleset, nil); err != nil {
+			return err
+		}
+		return errors.Wrapf(notAllowedByRulesetError, "Request to %s", dest.Address())
+	}
+
 	switch request.Command {
 	case ConnectCommand:
 		return s.handleConnectRequest(conn, request)
+	case BindCommand:
+		return s.handleBindRequest(conn, request)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+		if err := request.reply(conn, commandNotSupported, nil); err != nil {
 			return err
 		}
 	}
@@ -376,12 +535,21 @@ func (s *server) handleRequest(request *Request, conn net.Conn) error {
 	return nil
 }
 
+// resolve 使用配置的解析器解析域名，与net.ResolveIPAddr相同，优先使用IPv4地址
 func (s *server) resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
+	ips, _, err := s.resolver.Resolve(ctx, name)
 	if err != nil {
 		return ctx, nil, err
 	}
-	return ctx, addr.IP, err
+	if len(ips) == 0 {
+		return ctx, nil, errors.New(fmt.Sprintf("No address found for %s", name))
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ctx, ip, nil
+		}
+	}
+	return ctx, ips[0], nil
 }
 
 func (s *server) handleConnectRequest(conn net.Conn, request *Request) error {
@@ -394,7 +562,7 @@ func (s *server) handleConnectRequest(conn net.Conn, request *Request) error {
 		} else if strings.Contains(msg, "network is unreachable") {
 			resp = networkUnreachable
 		}
-		if err := sendReply(conn, resp, nil); err != nil {
+		if err := request.reply(conn, resp, nil); err != nil {
 			return err
 		}
 		return err
@@ -405,10 +573,15 @@ func (s *server) handleConnectRequest(conn net.Conn, request *Request) error {
 
 	local := target.LocalAddr().(*net.TCPAddr)
 	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, succeeded, &bind); err != nil {
+	if err := request.reply(conn, succeeded, &bind); err != nil {
 		return err
 	}
 
+	return splice(conn, request, target)
+}
+
+// splice 在客户端与目标连接之间双向转发数据，直到任意一方出错或双方都关闭
+func splice(conn net.Conn, request *Request, target net.Conn) error {
 	errCh := make(chan error, 2)
 	go proxy.Proxy(target, request.reader, errCh)
 	go proxy.Proxy(conn, target, errCh)
@@ -422,6 +595,14 @@ func (s *server) handleConnectRequest(conn net.Conn, request *Request) error {
 	return nil
 }
 
+// RejectedClients 返回按客户端地址拒绝的连接数，服务尚未启动时为0
+func (s *server) RejectedClients() uint64 {
+	if s.clientFilter == nil {
+		return 0
+	}
+	return s.clientFilter.Rejected()
+}
+
 func (s *server) StopServer() {
 	socks5.Suicide(socks5.ServerSidePidPath)
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/liruonian/socks5/server/auth"
+)
+
+func (s *server) handleSocks4(ctx context.Context, reader *bufio.Reader, conn net.Conn) {
+	if s.config.DisableSocks4 {
+		logrus.Errorf("Socks4 is disabled, reject connection from %s", conn.RemoteAddr().String())
+		return
+	}
+
+	request, err := s.newSocks4Request(reader)
+	if err != nil {
+		logrus.Errorf("Error occoured while process socks4 request: %s", err.Error())
+		return
+	}
+	request.RemoteAddr = clientAddrSpec(conn)
+	request.Identity = auth.AnonymousIdentity(ctx)
+
+	// SOCKS4无法进行认证，仅在服务端接受无认证模式时处理SOCKS4请求
+	if !s.authMethodAllowed(auth.NoAuthenticationMethod) {
+		logrus.Errorf("Socks4 request from %s rejected, authentication is required", conn.RemoteAddr().String())
+		_ = request.reply(conn, connectionNotAllowedByRuleset, nil)
+		return
+	}
+
+	// SOCKS4只定义了CONNECT和BIND命令
+	if request.Command != ConnectCommand && request.Command != BindCommand {
+		_ = request.reply(conn, commandNotSupported, nil)
+		return
+	}
+
+	// 处理请求
+	if err := s.handleRequest(ctx, request, conn); err != nil {
+		logrus.Errorf("Error occoured while handle request: %s", err.Error())
+		return
+	}
+}
+
+func (s *server) newSocks4Request(reader *bufio.Reader) (*Request, error) {
+	// VN已在协商版本时读取，剩余部分为 CD | DSTPORT | DSTIP | USERID | NULL
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	dest := &AddrSpec{
+		IP:   net.IP(header[3:7]),
+		Port: (int(header[1]) << 8) | int(header[2]),
+	}
+
+	userID, err := readNullTerminated(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// SOCKS4a：DSTIP为0.0.0.x（x不为0）时，USERID之后紧跟以NULL结尾的目的域名
+	if dest.IP[0] == 0 && dest.IP[1] == 0 && dest.IP[2] == 0 && dest.IP[3] != 0 {
+		fqdn, err := readNullTerminated(reader)
+		if err != nil {
+			return nil, err
+		}
+		dest.IP = nil
+		dest.FQDN = fqdn
+	}
+	logrus.Debugf("Socks4 request for %s, userid: %s", dest.String(), userID)
+
+	return &Request{
+		Version:   socks4Version,
+		Command:   header[0],
+		DestAddr:  dest,
+		reader:    reader,
+		replyFunc: sendSocks4Reply,
+	}, nil
+}
+
+func readNullTerminated(reader *bufio.Reader) (string, error) {
+	// ReadSlice的长度受限于缓冲区大小，避免读取无限长的字段
+	field, err := reader.ReadSlice(0)
+	if err != nil {
+		return "", err
+	}
+	return string(field[:len(field)-1]), nil
+}
+
+func sendSocks4Reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	// SOCKS4只区分成功与失败两种结果
+	msg := []byte{socks4ReplyVersion, socks4Granted, 0, 0, 0, 0, 0, 0}
+	if resp != succeeded {
+		msg[1] = socks4Rejected
+	}
+
+	// 仅能回复IPv4地址，其他类型的地址以0填充
+	if addr != nil {
+		if ip := addr.IP.To4(); ip != nil {
+			msg[2] = byte(addr.Port >> 8)
+			msg[3] = byte(addr.Port & 0xff)
+			copy(msg[4:], ip)
+		}
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/liruonian/socks5"
+	"github.com/liruonian/socks5/proxy"
+	"github.com/liruonian/socks5/server/auth"
+)
+
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// initTransport 根据配置初始化TLS以及预共享密钥加密，两者同时配置时TLS在外层
+func (s *server) initTransport() error {
+	if len(s.config.TLSCert) != 0 {
+		cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+
+		// 配置客户端CA后要求双向认证，客户端证书作为额外的认证因素
+		if len(s.config.TLSClientCA) != 0 {
+			pool, err := socks5.LoadCertPool(s.config.TLSClientCA)
+			if err != nil {
+				return err
+			}
+			s.tlsConfig.ClientCAs = pool
+			s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if len(s.config.Key) != 0 {
+		cipher, err := proxy.NewCipher(s.config.Cipher, s.config.Key)
+		if err != nil {
+			return err
+		}
+		cipher.SetReplayFilter(proxy.NewSaltFilter(proxy.DefaultSaltFilterSize))
+		s.cipher = cipher
+	}
+	return nil
+}
+
+// wrapConn 终止TLS，返回的ctx中带有客户端证书的名称
+func (s *server) wrapConn(ctx context.Context, conn net.Conn) (context.Context, net.Conn, error) {
+	if s.tlsConfig != nil {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			return ctx, nil, err
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) != 0 {
+			ctx = auth.WithPeerName(ctx, certs[0].Subject.CommonName)
+		}
+		conn = tlsConn
+	}
+	return ctx, conn, nil
+}
+
+// serveTunnel 处理TLS之内的连接，配置了预共享密钥时先解密
+// WebSocket的升级请求需要以明文经过HTTP防火墙，因此在解密之前识别，升级之后的数据再解密
+func (s *server) serveTunnel(ctx context.Context, conn net.Conn) {
+	if s.cipher == nil {
+		s.serve(ctx, conn, true)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	if len(s.config.WebSocketPath) != 0 {
+		preface := "GET " + s.config.WebSocketPath
+		if head, _ := reader.Peek(len(preface)); string(head) == preface {
+			req, err := http.ReadRequest(reader)
+			if err != nil || req.URL.Path != s.config.WebSocketPath || !proxy.IsWebSocketUpgrade(req) {
+				_ = proxy.WriteHTTPStatus(conn, http.StatusBadRequest, nil)
+				return
+			}
+			s.handleWebSocket(ctx, req, reader, conn)
+			return
+		}
+	}
+	s.serve(ctx, proxy.NewSecureConn(proxy.NewBufferedConn(conn, reader), s.cipher), true)
+}
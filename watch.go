@@ -0,0 +1,35 @@
+package socks5
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchFile 定期检查文件的修改时间和大小，发生变化时回调onChange，直到ctx结束
+func WatchFile(ctx context.Context, filePath string, interval time.Duration, onChange func()) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(filePath); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(filePath)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			onChange()
+		}
+	}
+}